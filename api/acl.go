@@ -0,0 +1,195 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/soulski/dmp/discovery"
+	"github.com/soulski/dmp/util"
+)
+
+type Capability string
+
+const (
+	REGISTER  Capability = "register"
+	REQUEST   Capability = "request"
+	NOTIFY    Capability = "notify"
+	PUBLISH   Capability = "publish"
+	SUBSCRIBE Capability = "subscribe"
+	READ      Capability = "read"
+	ADMIN     Capability = "admin"
+
+	// grants every namespace, or every resource of a capability.
+	ANY_RESOURCE = "*"
+)
+
+/*
+
+	Policy lists the resources a caller may use per capability. Namespaces
+	of register, request, notify and read are matched exactly or by "*".
+	Topics of publish and subscribe are patterns with the wildcards of
+	subscriptions, a subscription is allowed only when a granted pattern
+	covers all the topics it matches. Admin covers balancers, dead letters
+	and the gossip keyring, its resources are namespaces or "*".
+
+*/
+
+type Policy struct {
+	Register  []string `json:"register,omitempty"`
+	Request   []string `json:"request,omitempty"`
+	Notify    []string `json:"notify,omitempty"`
+	Publish   []string `json:"publish,omitempty"`
+	Subscribe []string `json:"subscribe,omitempty"`
+	Read      []string `json:"read,omitempty"`
+	Admin     []string `json:"admin,omitempty"`
+}
+
+func (p *Policy) Validate() error {
+	for _, patterns := range [][]string{p.Publish, p.Subscribe} {
+		for _, pattern := range patterns {
+			if pattern == ANY_RESOURCE {
+				continue
+			}
+
+			if err := discovery.ValidateTopicPattern(pattern); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) grants(capability Capability) []string {
+	switch capability {
+	case REGISTER:
+		return p.Register
+	case REQUEST:
+		return p.Request
+	case NOTIFY:
+		return p.Notify
+	case PUBLISH:
+		return p.Publish
+	case SUBSCRIBE:
+		return p.Subscribe
+	case READ:
+		return p.Read
+	case ADMIN:
+		return p.Admin
+	}
+
+	return nil
+}
+
+func (p *Policy) Allow(capability Capability, resource string) bool {
+	for _, grant := range p.grants(capability) {
+		if grant == ANY_RESOURCE || grant == resource {
+			return true
+		}
+
+		if (capability == PUBLISH || capability == SUBSCRIBE) && coversTopic(grant, resource) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// coversTopic reports whether every topic matching pattern also matches
+// grant.
+func coversTopic(grant string, pattern string) bool {
+	grantLevels := strings.Split(grant, discovery.TOPIC_SEPARATOR)
+	levels := strings.Split(pattern, discovery.TOPIC_SEPARATOR)
+
+	for index, level := range grantLevels {
+		if level == discovery.MULTI_LEVEL_WILDCARD {
+			return true
+		}
+
+		if index >= len(levels) {
+			return false
+		}
+
+		switch level {
+		case discovery.SINGLE_LEVEL_WILDCARD:
+			if levels[index] == discovery.MULTI_LEVEL_WILDCARD {
+				return false
+			}
+		case levels[index]:
+		default:
+			return false
+		}
+	}
+
+	return len(levels) == len(grantLevels)
+}
+
+// permission is a capability an action needs on the resource read from
+// the request.
+type permission struct {
+	capability Capability
+	resource   func(httpReq *http.Request) (string, error)
+	optional   bool
+}
+
+func (p *permission) check(identity *Identity, policy *Policy, httpReq *http.Request) error {
+	resource, err := p.resource(httpReq)
+	if err != nil {
+		return err
+	}
+
+	if p.optional && resource == "" {
+		return nil
+	}
+
+	if !policy.Allow(p.capability, resource) {
+		return util.CreateForbiddenErr(identity.Name, string(p.capability), resource)
+	}
+
+	return nil
+}
+
+func fromVar(name string) func(*http.Request) (string, error) {
+	return func(httpReq *http.Request) (string, error) {
+		return mux.Vars(httpReq)[name], nil
+	}
+}
+
+func fromQuery(name string) func(*http.Request) (string, error) {
+	return func(httpReq *http.Request) (string, error) {
+		return httpReq.URL.Query().Get(name), nil
+	}
+}
+
+func fromHeader(name string) func(*http.Request) (string, error) {
+	return func(httpReq *http.Request) (string, error) {
+		return httpReq.Header.Get(name), nil
+	}
+}
+
+func anyResource(httpReq *http.Request) (string, error) {
+	return ANY_RESOURCE, nil
+}
+
+// fromBody reads the namespace of a JSON body, the body is put back for
+// the action.
+func fromBody(httpReq *http.Request) (string, error) {
+	body, err := peekBody(httpReq)
+	if err != nil {
+		return "", err
+	}
+
+	var target struct {
+		Namespace string `json:"namespace"`
+	}
+
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &target); err != nil {
+			return "", util.CreateInvalidArgs("body", err.Error())
+		}
+	}
+
+	return target.Namespace, nil
+}
@@ -1,18 +1,59 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/soulski/dmp/api/req"
 	"github.com/soulski/dmp/api/res"
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/metrics"
+	"github.com/soulski/dmp/tracing"
+	"github.com/soulski/dmp/util"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	TIMEOUT_HEADER     = "X-DMP-Timeout"
+	IDEMPOTENT_HEADER  = "X-DMP-Idempotent"
+	RETRIES_HEADER     = "X-DMP-Retries"
+	ROUTING_KEY_HEADER = "X-DMP-Routing-Key"
+	BROADCAST_HEADER   = "X-DMP-Broadcast"
+	SOURCE_HEADER      = "X-DMP-Source"
+	CORRELATION_HEADER = "X-Correlation-ID"
+
+	// headers of the API itself, not given to subscription filters.
+	CONTROL_HEADER_PREFIX = "X-Dmp-"
+
+	DEFAULT_PORT = 8080
+
+	DEFAULT_MAX_BODY_SIZE = 4 * 1024 * 1024
+)
+
+// PRIVATE_HEADERS carry credentials, they are not given to subscription
+// filters.
+var PRIVATE_HEADERS = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
 type HttpMethod string
 
 const (
@@ -23,90 +64,343 @@ const (
 )
 
 var URLSchema = map[string]*Action{
-	"GET:/namespace":                       action(listAllMember),
-	"GET:/namespace/{namespace}":           action(listMember),
-	"PUT:/namespace":                       action(serviceRegister),
-	"DELETE:/namespace/{namespace}":        action(serviceUnregister),
-	"PUT:/message/reqRes/{namespace}":      action(request),
-	"PUT:/message/pubSub/{topic}":          action(publish),
-	"PUT:/message/noti/{namespace}":        action(notificate),
-	"PUT:/topic/{topicName}/subscriber":    action(subscribeTopic),
-	"DELETE:/topic/{topicName}/subscriber": action(unsubscribeTopic),
+	"GET:/namespace":                       action(listAllMember).requires(READ, anyResource),
+	"GET:/namespace/{namespace}":           action(listMember).requires(READ, fromVar("namespace")),
+	"GET:/namespace/{namespace}/watch":     action(watchMember).requires(READ, fromVar("namespace")),
+	"PUT:/namespace":                       action(serviceRegister).requires(REGISTER, fromBody),
+	"DELETE:/namespace/{namespace}":        action(serviceUnregister).requires(REGISTER, fromVar("namespace")),
+	"GET:/namespace/{namespace}/balancer":  action(getBalancer).requires(READ, fromVar("namespace")),
+	"PUT:/namespace/{namespace}/balancer":  action(setBalancer).requires(ADMIN, fromVar("namespace")),
+	"PUT:/message/reqRes/{namespace}":      action(request).requires(REQUEST, fromVar("namespace")).requiresGiven(REGISTER, fromHeader(SOURCE_HEADER)),
+	"PUT:/message/pubSub/{topic}":          action(publish).requires(PUBLISH, fromVar("topic")).requiresGiven(REGISTER, fromHeader(SOURCE_HEADER)),
+	"PUT:/message/noti/{namespace}":        action(notificate).requires(NOTIFY, fromVar("namespace")).requiresGiven(REGISTER, fromHeader(SOURCE_HEADER)),
+	"PUT:/topic/{topicName}/subscriber":    action(subscribeTopic).requires(SUBSCRIBE, fromVar("topicName")).requires(REGISTER, fromBody),
+	"DELETE:/topic/{topicName}/subscriber": action(unsubscribeTopic).requires(SUBSCRIBE, fromVar("topicName")).requires(REGISTER, fromQuery("namespace")),
+	"GET:/deadletter":                      action(listDeadLetters).requires(ADMIN, anyResource),
+	"DELETE:/deadletter":                   action(purgeDeadLetters).requires(ADMIN, anyResource),
+	"GET:/deadletter/{id}":                 action(getDeadLetter).requires(ADMIN, anyResource),
+	"DELETE:/deadletter/{id}":              action(deleteDeadLetter).requires(ADMIN, anyResource),
+	"PUT:/deadletter/{id}/replay":          action(replayDeadLetter).requires(ADMIN, anyResource),
+	"GET:/keyring":                         action(listKeys).requires(ADMIN, anyResource),
+	"POST:/keyring":                        action(installKey).requires(ADMIN, anyResource),
+	"PUT:/keyring":                         action(useKey).requires(ADMIN, anyResource),
+	"DELETE:/keyring":                      action(removeKey).requires(ADMIN, anyResource),
+	"GET:/metrics":                         action(serveMetrics).requires(READ, anyResource),
+	"GET:/logging":                         action(getLogLevels).requires(ADMIN, anyResource),
+	"PUT:/logging/{subsystem}":             action(setLogLevel).requires(ADMIN, anyResource),
 }
 
 type API interface {
-	ServiceRegister(ns string, contactPoint string) (*res.Member, error)
-	ServiceUnregister() bool
+	ServiceRegister(ns string, contactPoint string, check *req.Check) (*res.Member, error)
+	ServiceUnregister(namespace string) bool
 	ListMembers(ns string) *res.Members
 	ListAllMembers() *res.Members
-	Request(namespace string, msg []byte) ([]byte, error)
-	Publish(topic string, msg []byte) ([]byte, error)
-	Notificate(namespace string, msg []byte) ([]byte, error)
-	SubscribeTopic(topicName string) bool
-	UnsubscribeTopic(topicName string) bool
+	WatchMembers(ns string) (<-chan *res.Members, func())
+	Request(namespace string, msg []byte, opts *req.Options) (*res.Reply, error)
+	Publish(topic string, msg []byte, opts *req.Options) (*res.Publish, error)
+	Notificate(namespace string, msg []byte, opts *req.Options) ([]byte, error)
+	SubscribeTopic(namespace string, topicName string, filter string) (bool, error)
+	UnsubscribeTopic(namespace string, topicName string) bool
+	GetBalancer(namespace string) *res.Balancer
+	SetBalancer(namespace string, strategy string) (*res.Balancer, error)
+	ListDeadLetters(namespace string, topic string) *res.DeadLetters
+	GetDeadLetter(id uint64) (*res.DeadLetter, error)
+	ReplayDeadLetter(id uint64) (*res.DeadLetter, error)
+	DeleteDeadLetter(id uint64) (bool, error)
+	PurgeDeadLetters(namespace string, topic string) (int, error)
+	ListKeys() (*res.Keyring, error)
+	InstallKey(key string) (*res.Keyring, error)
+	UseKey(key string) (*res.Keyring, error)
+	RemoveKey(key string) (*res.Keyring, error)
+	LogLevels() *res.LogLevels
+	SetLogLevel(subsystem string, level string) (*res.LogLevels, error)
 }
 
 type Action struct {
 	api    API
+	auth   *Auth
 	method HttpMethod
+	route  string
 	action func(api API, w http.ResponseWriter, req *http.Request)
+	logger *slog.Logger
+
+	maxBodySize int64
+
+	// closed once the server shuts down, long lived calls end on it.
+	closing <-chan struct{}
+
+	permissions []*permission
 }
 
 func action(action func(api API, w http.ResponseWriter, req *http.Request)) *Action {
 	return &Action{action: action}
 }
 
+// requires adds a capability the caller needs on the resource read from the
+// request, checked when the API runs with authentication.
+func (a *Action) requires(capability Capability, resource func(*http.Request) (string, error)) *Action {
+	a.permissions = append(a.permissions, &permission{capability: capability, resource: resource})
+	return a
+}
+
+// requiresGiven is requires for a resource the request may leave out, it is
+// checked only when given.
+func (a *Action) requiresGiven(capability Capability, resource func(*http.Request) (string, error)) *Action {
+	a.permissions = append(a.permissions, &permission{capability: capability, resource: resource, optional: true})
+	return a
+}
+
 func (a *Action) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := tracing.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := tracing.Start(ctx, a.route, trace.SpanKindServer)
+	defer span.End()
+
+	correlation := req.Header.Get(CORRELATION_HEADER)
+	if correlation == "" {
+		correlation = logging.NewCorrelationID()
+	}
+	w.Header().Set(CORRELATION_HEADER, correlation)
+
+	ctx = logging.WithCorrelation(ctx, correlation)
+	ctx = withRouteFields(ctx, req)
+	ctx = context.WithValue(ctx, loggerKey{}, a.logger)
+	ctx = context.WithValue(ctx, closingKey{}, a.closing)
+
+	req = req.WithContext(ctx)
+	a.logger.DebugContext(ctx, "Handle API call", "route", a.route)
+
+	// authentication reads the body, it is bounded before that.
+	if req.Body != nil {
+		req.Body = http.MaxBytesReader(w, req.Body, a.maxBodySize)
+	}
+
+	if a.auth != nil {
+		identity, policy, err := a.auth.Authenticate(req)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		for _, perm := range a.permissions {
+			if err := perm.check(identity, policy, req); err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+		}
+
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, identity))
+	}
+
 	a.action(a.api, w, req)
 }
 
+type loggerKey struct{}
+
+type closingKey struct{}
+
+// closing is closed once the server serving the call shuts down.
+func closing(httpReq *http.Request) <-chan struct{} {
+	ch, _ := httpReq.Context().Value(closingKey{}).(<-chan struct{})
+	return ch
+}
+
+// withRouteFields adds the namespace and topic the call is about, when the
+// route has them, to the records logged with ctx.
+func withRouteFields(ctx context.Context, req *http.Request) context.Context {
+	fields := []any{}
+
+	vars := mux.Vars(req)
+	if ns, ok := vars["namespace"]; ok {
+		fields = append(fields, "namespace", ns)
+	}
+
+	if topic, ok := vars["topic"]; ok {
+		fields = append(fields, "topic", topic)
+	} else if topic, ok := vars["topicName"]; ok {
+		fields = append(fields, "topic", topic)
+	}
+
+	if len(fields) == 0 {
+		return ctx
+	}
+
+	return logging.WithFields(ctx, fields...)
+}
+
+// logWriteError logs a response that could not be written to the caller.
+func logWriteError(httpReq *http.Request, err error) {
+	ctx := httpReq.Context()
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		logger.WarnContext(ctx, "Error while write response", logging.ERROR_KEY, err)
+	}
+}
+
+// Config of the API server, a nil Auth lets every caller in and a nil TLS
+// serves plain HTTP. Addr is host:port, every interface on DEFAULT_PORT
+// when empty, and Socket the path of a Unix socket also served when set.
+// A call with a body larger than MaxBodySize is refused before it is
+// authenticated, DEFAULT_MAX_BODY_SIZE when not set.
+type Config struct {
+	Auth        *Auth
+	TLS         *tls.Config
+	Addr        string
+	Socket      string
+	MaxBodySize int64
+}
+
 type ApiServer struct {
 	router *closableRouter
+	server *http.Server
 	api    API
+	conf   *Config
+
+	listener net.Listener
+	socket   net.Listener
 
 	urlSchema map[string]Action
 
-	running bool
-	logger  *log.Logger
+	closing chan struct{}
+	logger  *slog.Logger
 }
 
-func CreateApiServer(api API, logger *log.Logger) *ApiServer {
+func CreateApiServer(api API, conf *Config, logger *slog.Logger) *ApiServer {
 	sMux := mux.NewRouter()
+	closing := make(chan struct{})
+
+	maxBodySize := conf.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DEFAULT_MAX_BODY_SIZE
+	}
 
 	for url, handler := range URLSchema {
 		elems := strings.Split(url, ":")
 		method, url := elems[0], elems[1]
 
 		handler.api = api
+		handler.auth = conf.Auth
 		handler.method = HttpMethod(method)
+		handler.route = method + " " + url
+		handler.logger = logger
+		handler.closing = closing
+		handler.maxBodySize = maxBodySize
 		sMux.Handle(url, handler).Methods(method)
 	}
 
+	router := &closableRouter{Router: sMux}
+
 	return &ApiServer{
-		api:    api,
-		logger: logger,
-		router: &closableRouter{sMux, false},
+		api:     api,
+		conf:    conf,
+		logger:  logger,
+		router:  router,
+		closing: closing,
+		server: &http.Server{
+			Handler:   router,
+			TLSConfig: conf.TLS,
+		},
 	}
 }
 
+// Listen binds the address and the Unix socket of the API, calls are served
+// once Start runs.
+func (c *ApiServer) Listen() error {
+	addr := c.conf.Addr
+	if addr == "" {
+		addr = ":" + strconv.Itoa(DEFAULT_PORT)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("API cannot listen on %s : %w", addr, err)
+	}
+
+	if c.conf.Socket != "" {
+		socket, err := listenUnix(c.conf.Socket)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("API cannot listen on socket %s : %w", c.conf.Socket, err)
+		}
+
+		c.socket = socket
+	}
+
+	c.listener = ln
+
+	return nil
+}
+
+// listenUnix removes the socket file a previous run left behind, unless a
+// process still answers on it.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, syscall.EADDRINUSE
+		}
+
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+// Start serves calls until Stop, Listen is called first when it was not.
+// The Unix socket serves plain HTTP even when TLS is set.
 func (c *ApiServer) Start() {
-	server := &http.Server{
-		Addr:    ":8080",
-		Handler: c.router,
+	if c.listener == nil {
+		if err := c.Listen(); err != nil {
+			c.logger.Error("Error while serve API", logging.ERROR_KEY, err)
+			return
+		}
 	}
 
-	server.ListenAndServe()
+	if c.socket != nil {
+		go c.serve(c.socket, false)
+	}
+
+	c.serve(c.listener, c.conf.TLS != nil)
 }
 
-func (c *ApiServer) Stop() error {
+func (c *ApiServer) serve(ln net.Listener, useTLS bool) {
+	c.logger.Info("API listening", "addr", ln.Addr().String(), "tls", useTLS)
+
+	var err error
+	if useTLS {
+		err = c.server.ServeTLS(ln, "", "")
+	} else {
+		err = c.server.Serve(ln)
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		c.logger.Error("Error while serve API", "addr", ln.Addr().String(), logging.ERROR_KEY, err)
+	}
+}
+
+// Stop takes no new call and waits until the calls being served are
+// answered, or ctx is done. Watches of members end right away.
+func (c *ApiServer) Stop(ctx context.Context) error {
 	c.router.Close()
-	return nil
+	close(c.closing)
+
+	err := c.server.Shutdown(ctx)
+
+	// listeners that were never served are not closed by Shutdown.
+	for _, ln := range []net.Listener{c.listener, c.socket} {
+		if ln != nil {
+			ln.Close()
+		}
+	}
+
+	return err
 }
 
-func RunAPI(api API, logger *log.Logger) (*ApiServer, chan bool, error) {
+func RunAPI(api API, conf *Config, logger *slog.Logger) (*ApiServer, chan bool, error) {
 	started := make(chan bool)
 
-	apiServ := CreateApiServer(api, logger)
+	apiServ := CreateApiServer(api, conf, logger)
+	if err := apiServ.Listen(); err != nil {
+		return nil, nil, err
+	}
 
 	go func() {
 		started <- true
@@ -116,22 +410,26 @@ func RunAPI(api API, logger *log.Logger) (*ApiServer, chan bool, error) {
 	return apiServ, started, nil
 }
 
+// closableRouter answers 503 to calls that come in on a kept alive
+// connection once the server is closing.
 type closableRouter struct {
 	*mux.Router
 
-	closed bool
+	closed atomic.Bool
 }
 
 func (r *closableRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if r.closed != true {
-		r.Router.ServeHTTP(w, req)
-	} else {
-		fmt.Fprint(w, "connection closed")
+	if r.closed.Load() {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
 	}
+
+	r.Router.ServeHTTP(w, req)
 }
 
 func (r *closableRouter) Close() {
-	r.closed = true
+	r.closed.Store(true)
 }
 
 func listAllMember(api API, w http.ResponseWriter, httpReq *http.Request) {
@@ -148,6 +446,42 @@ func listMember(api API, w http.ResponseWriter, httpReq *http.Request) {
 	}
 }
 
+// watchMember streams the members of a namespace, one JSON document per line,
+// first the current members then again on every change.
+func watchMember(api API, w http.ResponseWriter, httpReq *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	members, stop := api.WatchMembers(mux.Vars(httpReq)["namespace"])
+	defer stop()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case result, ok := <-members:
+			if !ok {
+				return
+			}
+
+			if err := encoder.Encode(result); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-httpReq.Context().Done():
+			return
+		case <-closing(httpReq):
+			return
+		}
+	}
+}
+
 func serviceRegister(api API, w http.ResponseWriter, httpReq *http.Request) {
 	var service req.Service
 
@@ -160,6 +494,7 @@ func serviceRegister(api API, w http.ResponseWriter, httpReq *http.Request) {
 	s, err := api.ServiceRegister(
 		service.Namespace,
 		service.ContactPoint,
+		service.Check,
 	)
 
 	if err != nil {
@@ -171,24 +506,222 @@ func serviceRegister(api API, w http.ResponseWriter, httpReq *http.Request) {
 }
 
 func serviceUnregister(api API, w http.ResponseWriter, httpReq *http.Request) {
-	success := api.ServiceUnregister()
+	success := api.ServiceUnregister(mux.Vars(httpReq)["namespace"])
 	writeJSON(w, &res.Result{Result: success})
 }
 
+func getBalancer(api API, w http.ResponseWriter, httpReq *http.Request) {
+	result := api.GetBalancer(mux.Vars(httpReq)["namespace"])
+	if err := writeJSON(w, result); err != nil {
+		http.Error(w, err.Error(), 403)
+	}
+}
+
+func setBalancer(api API, w http.ResponseWriter, httpReq *http.Request) {
+	var balancer req.Balancer
+
+	decoder := json.NewDecoder(httpReq.Body)
+	if err := decoder.Decode(&balancer); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
+	result, err := api.SetBalancer(mux.Vars(httpReq)["namespace"], balancer.Strategy)
+	if err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
+	writeJSON(w, result)
+}
+
 func subscribeTopic(api API, w http.ResponseWriter, httpReq *http.Request) {
 	topic := mux.Vars(httpReq)["topicName"]
 
-	success := api.SubscribeTopic(topic)
+	var subscription req.Subscription
+
+	decoder := json.NewDecoder(httpReq.Body)
+	if err := decoder.Decode(&subscription); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	success, err := api.SubscribeTopic(subscription.Namespace, topic, subscription.Filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	writeJSON(w, &res.Result{Result: success})
 }
 
 func unsubscribeTopic(api API, w http.ResponseWriter, httpReq *http.Request) {
 	topic := mux.Vars(httpReq)["topicName"]
 
-	success := api.UnsubscribeTopic(topic)
+	success := api.UnsubscribeTopic(httpReq.URL.Query().Get("namespace"), topic)
 	writeJSON(w, &res.Result{Result: success})
 }
 
+func listDeadLetters(api API, w http.ResponseWriter, httpReq *http.Request) {
+	query := httpReq.URL.Query()
+
+	result := api.ListDeadLetters(query.Get("namespace"), query.Get("topic"))
+	if err := writeJSON(w, result); err != nil {
+		http.Error(w, err.Error(), 403)
+	}
+}
+
+func purgeDeadLetters(api API, w http.ResponseWriter, httpReq *http.Request) {
+	query := httpReq.URL.Query()
+
+	purged, err := api.PurgeDeadLetters(query.Get("namespace"), query.Get("topic"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, &res.Result{Result: purged})
+}
+
+func getDeadLetter(api API, w http.ResponseWriter, httpReq *http.Request) {
+	id, err := readLetterID(httpReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	letter, err := api.GetDeadLetter(id)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(w, letter)
+}
+
+func deleteDeadLetter(api API, w http.ResponseWriter, httpReq *http.Request) {
+	id, err := readLetterID(httpReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	success, err := api.DeleteDeadLetter(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, &res.Result{Result: success})
+}
+
+func replayDeadLetter(api API, w http.ResponseWriter, httpReq *http.Request) {
+	id, err := readLetterID(httpReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	letter, err := api.ReplayDeadLetter(id)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(w, letter)
+}
+
+func readLetterID(httpReq *http.Request) (uint64, error) {
+	id := mux.Vars(httpReq)["id"]
+
+	letterID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, util.CreateInvalidArgs("id", id)
+	}
+
+	return letterID, nil
+}
+
+func serveMetrics(api API, w http.ResponseWriter, httpReq *http.Request) {
+	metrics.Handler().ServeHTTP(w, httpReq)
+}
+
+func getLogLevels(api API, w http.ResponseWriter, httpReq *http.Request) {
+	writeJSON(w, api.LogLevels())
+}
+
+func setLogLevel(api API, w http.ResponseWriter, httpReq *http.Request) {
+	subsystem := mux.Vars(httpReq)["subsystem"]
+
+	var level req.LogLevel
+
+	decoder := json.NewDecoder(httpReq.Body)
+	if err := decoder.Decode(&level); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	levels, err := api.SetLogLevel(subsystem, level.Level)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(w, levels)
+}
+
+func listKeys(api API, w http.ResponseWriter, httpReq *http.Request) {
+	writeKeyring(w, api.ListKeys)
+}
+
+func installKey(api API, w http.ResponseWriter, httpReq *http.Request) {
+	keyAction(api.InstallKey, w, httpReq)
+}
+
+func useKey(api API, w http.ResponseWriter, httpReq *http.Request) {
+	keyAction(api.UseKey, w, httpReq)
+}
+
+func removeKey(api API, w http.ResponseWriter, httpReq *http.Request) {
+	keyAction(api.RemoveKey, w, httpReq)
+}
+
+func keyAction(operation func(key string) (*res.Keyring, error), w http.ResponseWriter, httpReq *http.Request) {
+	var key req.Key
+
+	decoder := json.NewDecoder(httpReq.Body)
+	if err := decoder.Decode(&key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeKeyring(w, func() (*res.Keyring, error) {
+		return operation(key.Key)
+	})
+}
+
+// writeKeyring answers 207 with the keyring when some nodes failed the
+// operation.
+func writeKeyring(w http.ResponseWriter, operation func() (*res.Keyring, error)) {
+	keyring, err := operation()
+	if keyring == nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	body, mErr := json.Marshal(keyring)
+	if mErr != nil {
+		http.Error(w, mErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	w.Write(body)
+}
+
 func request(api API, w http.ResponseWriter, httpReq *http.Request) {
 	params := mux.Vars(httpReq)
 
@@ -201,11 +734,12 @@ func request(api API, w http.ResponseWriter, httpReq *http.Request) {
 	b, err := ioutil.ReadAll(httpReq.Body)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(errorStatus(err))
 		w.Write([]byte("Error : " + err.Error()))
+		return
 	}
 
-	res, err := api.Request(ns, b)
+	opts, err := readOptions(httpReq)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Error : " + err.Error()))
@@ -213,10 +747,22 @@ func request(api API, w http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	reply, err := api.Request(ns, b, opts)
+	if reply != nil {
+		w.Header().Set(RETRIES_HEADER, strconv.Itoa(reply.Retries))
+	}
+
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		w.Write([]byte("Error : " + err.Error()))
+
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	if _, err := w.Write(res); err != nil {
-		fmt.Println("Error : ", err)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(reply.Body); err != nil {
+		logWriteError(httpReq, err)
 	}
 }
 
@@ -231,11 +777,12 @@ func publish(api API, w http.ResponseWriter, httpReq *http.Request) {
 
 	b, err := ioutil.ReadAll(httpReq.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(errorStatus(err))
 		w.Write([]byte("Error : " + err.Error()))
+		return
 	}
 
-	res, err := api.Publish(ns, b)
+	opts, err := readOptions(httpReq)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Error : " + err.Error()))
@@ -243,13 +790,39 @@ func publish(api API, w http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	result, err := api.Publish(ns, b, opts)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		w.Write([]byte("Error : " + err.Error()))
+
+		return
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	if _, err := w.Write(res); err != nil {
-		fmt.Println("Error : ", err)
+	w.WriteHeader(publishStatus(result))
+	if _, err := w.Write(body); err != nil {
+		logWriteError(httpReq, err)
 	}
 }
 
+// publishStatus is 200 when every subscriber namespace got the message, 207
+// when only some of them did and 502 when none did.
+func publishStatus(result *res.Publish) int {
+	if len(result.Failed) == 0 {
+		return http.StatusOK
+	} else if len(result.Delivered) > 0 {
+		return http.StatusMultiStatus
+	}
+
+	return http.StatusBadGateway
+}
+
 func notificate(api API, w http.ResponseWriter, httpReq *http.Request) {
 	params := mux.Vars(httpReq)
 
@@ -261,11 +834,12 @@ func notificate(api API, w http.ResponseWriter, httpReq *http.Request) {
 
 	b, err := ioutil.ReadAll(httpReq.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(errorStatus(err))
 		w.Write([]byte("Error : " + err.Error()))
+		return
 	}
 
-	res, err := api.Notificate(ns, b)
+	opts, err := readOptions(httpReq)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Error : " + err.Error()))
@@ -273,11 +847,100 @@ func notificate(api API, w http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 
+	res, err := api.Notificate(ns, b, opts)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		w.Write([]byte("Error : " + err.Error()))
+
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(res); err != nil {
-		fmt.Println("Error : ", err)
+		logWriteError(httpReq, err)
+	}
+}
+
+func readOptions(httpReq *http.Request) (*req.Options, error) {
+	opts := &req.Options{Context: httpReq.Context()}
+
+	if timeout := httpReq.Header.Get(TIMEOUT_HEADER); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return nil, util.CreateInvalidArgs(TIMEOUT_HEADER, timeout)
+		}
+
+		opts.Timeout = d
+	}
+
+	if idempotent := httpReq.Header.Get(IDEMPOTENT_HEADER); idempotent != "" {
+		b, err := strconv.ParseBool(idempotent)
+		if err != nil {
+			return nil, util.CreateInvalidArgs(IDEMPOTENT_HEADER, idempotent)
+		}
+
+		opts.Idempotent = b
 	}
+
+	opts.RoutingKey = httpReq.Header.Get(ROUTING_KEY_HEADER)
+	opts.Source = httpReq.Header.Get(SOURCE_HEADER)
+
+	opts.Headers = filterHeaders(httpReq.Header)
+
+	if broadcast := httpReq.Header.Get(BROADCAST_HEADER); broadcast != "" {
+		b, err := strconv.ParseBool(broadcast)
+		if err != nil {
+			return nil, util.CreateInvalidArgs(BROADCAST_HEADER, broadcast)
+		}
+
+		opts.Broadcast = b
+	}
+
+	return opts, nil
+}
+
+// filterHeaders returns the headers subscription filters may read. Filters
+// compare values, so credentials and the control headers of the API are
+// left out lest a subscriber guess them from the messages it gets.
+func filterHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+
+	for name := range header {
+		canonical := http.CanonicalHeaderKey(name)
+		if PRIVATE_HEADERS[canonical] || strings.HasPrefix(canonical, CONTROL_HEADER_PREFIX) {
+			continue
+		}
+
+		headers[name] = header.Get(name)
+	}
+
+	return headers
+}
+
+func errorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	if util.IsTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+
+	if util.IsNotFound(err) {
+		return http.StatusNotFound
+	}
+
+	if util.IsUnauthenticated(err) {
+		return http.StatusUnauthorized
+	}
+
+	if util.IsForbidden(err) {
+		return http.StatusForbidden
+	}
+
+	return http.StatusBadRequest
 }
 
 func writeJSON(w http.ResponseWriter, obj interface{}) (err error) {
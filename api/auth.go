@@ -0,0 +1,288 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	AUTHORIZATION_HEADER = "Authorization"
+	DATE_HEADER          = "X-DMP-Date"
+
+	BEARER_SCHEME = "Bearer"
+	HMAC_SCHEME   = "DMP-HMAC-SHA256"
+
+	// signed requests older or newer than this are rejected.
+	MAX_CLOCK_SKEW = 5 * time.Minute
+)
+
+// Identity is the caller of the API, Name selects its policy.
+type Identity struct {
+	Name   string
+	Method string
+}
+
+type identityKey struct{}
+
+// IdentityFrom returns the caller of an authenticated request.
+func IdentityFrom(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// Authenticator identifies the caller of a request. It returns nil without
+// error when the request carries no credentials of its kind, and an error
+// when it carries invalid ones.
+type Authenticator interface {
+	Authenticate(httpReq *http.Request) (*Identity, error)
+}
+
+// TokenAuth accepts static bearer tokens, each bound to an identity.
+type TokenAuth struct {
+	tokens map[string]string
+}
+
+func CreateTokenAuth(tokens map[string]string) *TokenAuth {
+	return &TokenAuth{tokens: tokens}
+}
+
+func (a *TokenAuth) Authenticate(httpReq *http.Request) (*Identity, error) {
+	scheme, credentials := readAuthorization(httpReq)
+	if scheme != BEARER_SCHEME {
+		return nil, nil
+	}
+
+	for token, name := range a.tokens {
+		if hmac.Equal([]byte(token), []byte(credentials)) {
+			return &Identity{Name: name, Method: "token"}, nil
+		}
+	}
+
+	return nil, util.CreateUnauthenticatedErr("unknown token")
+}
+
+type HMACKey struct {
+	Secret   string `json:"secret"`
+	Identity string `json:"identity"`
+}
+
+/*
+
+	HMACAuth accepts requests signed with a shared secret, as
+
+		Authorization: DMP-HMAC-SHA256 Credential=<key id>, Signature=<hex>
+		X-DMP-Date: <RFC 3339 time>
+
+	The signature is the HMAC-SHA256 of the method, the request URI, the
+	date and the hex SHA-256 of the body, each on its own line.
+
+*/
+
+type HMACAuth struct {
+	keys map[string]*HMACKey
+}
+
+func CreateHMACAuth(keys map[string]*HMACKey) *HMACAuth {
+	return &HMACAuth{keys: keys}
+}
+
+func (a *HMACAuth) Authenticate(httpReq *http.Request) (*Identity, error) {
+	scheme, credentials := readAuthorization(httpReq)
+	if scheme != HMAC_SCHEME {
+		return nil, nil
+	}
+
+	params := map[string]string{}
+	for _, param := range strings.Split(credentials, ",") {
+		elems := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(elems) == 2 {
+			params[elems[0]] = elems[1]
+		}
+	}
+
+	key, ok := a.keys[params["Credential"]]
+	if !ok {
+		return nil, util.CreateUnauthenticatedErr("unknown credential")
+	}
+
+	date := httpReq.Header.Get(DATE_HEADER)
+	signedAt, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return nil, util.CreateUnauthenticatedErr("invalid " + DATE_HEADER)
+	}
+
+	if skew := time.Since(signedAt); skew > MAX_CLOCK_SKEW || skew < -MAX_CLOCK_SKEW {
+		return nil, util.CreateUnauthenticatedErr(DATE_HEADER + " outside the allowed clock skew")
+	}
+
+	body, err := peekBody(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := SignRequest(key.Secret, httpReq.Method, httpReq.URL.RequestURI(), date, body)
+	if !hmac.Equal([]byte(expected), []byte(params["Signature"])) {
+		return nil, util.CreateUnauthenticatedErr("signature mismatch")
+	}
+
+	return &Identity{Name: key.Identity, Method: "hmac"}, nil
+}
+
+// SignRequest returns the hex signature HMACAuth expects of a request.
+func SignRequest(secret string, method string, uri string, date string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + date + "\n" + hex.EncodeToString(bodyHash[:])))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// TLSAuth identifies callers by the common name of the client certificate
+// the TLS listener verified.
+type TLSAuth struct{}
+
+func (a *TLSAuth) Authenticate(httpReq *http.Request) (*Identity, error) {
+	if httpReq.TLS == nil || len(httpReq.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+
+	return &Identity{Name: httpReq.TLS.VerifiedChains[0][0].Subject.CommonName, Method: "tls"}, nil
+}
+
+func readAuthorization(httpReq *http.Request) (string, string) {
+	elems := strings.SplitN(httpReq.Header.Get(AUTHORIZATION_HEADER), " ", 2)
+	if len(elems) != 2 {
+		return "", ""
+	}
+
+	return elems[0], strings.TrimSpace(elems[1])
+}
+
+// peekBody reads the body and puts it back for the action, the body is
+// bounded by the max body size of the server.
+func peekBody(httpReq *http.Request) ([]byte, error) {
+	if httpReq.Body == nil {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(httpReq.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Body.Close()
+	httpReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+/*
+
+	Auth authenticates API callers and checks their policy before an action
+	runs. It is read from a JSON file
+
+		{
+			"tokens":    {"<token>": "<identity>"},
+			"hmac-keys": {"<key id>": {"secret": "...", "identity": "<identity>"}},
+			"policies":  {"<identity>": {"register": ["orders"], "publish": ["orders.#"]}},
+			"anonymous": {"read": ["*"]}
+		}
+
+	Callers presenting a verified client certificate are identified by its
+	common name. Requests without credentials get the anonymous policy, or
+	are rejected when there is none.
+
+*/
+
+type Auth struct {
+	authenticators []Authenticator
+	policies       map[string]*Policy
+	anonymous      *Policy
+}
+
+type authFile struct {
+	Tokens    map[string]string   `json:"tokens"`
+	HMACKeys  map[string]*HMACKey `json:"hmac-keys"`
+	Policies  map[string]*Policy  `json:"policies"`
+	Anonymous *Policy             `json:"anonymous"`
+}
+
+func CreateAuth(authenticators []Authenticator, policies map[string]*Policy, anonymous *Policy) *Auth {
+	return &Auth{
+		authenticators: authenticators,
+		policies:       policies,
+		anonymous:      anonymous,
+	}
+}
+
+func LoadAuth(file string) (*Auth, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf authFile
+	if err := json.Unmarshal(content, &conf); err != nil {
+		return nil, err
+	}
+
+	for name, policy := range conf.Policies {
+		if err := policy.Validate(); err != nil {
+			return nil, util.CreateInvalidArgs("policy "+name, err.Error())
+		}
+	}
+
+	if conf.Anonymous != nil {
+		if err := conf.Anonymous.Validate(); err != nil {
+			return nil, util.CreateInvalidArgs("anonymous policy", err.Error())
+		}
+	}
+
+	authenticators := []Authenticator{&TLSAuth{}}
+	if len(conf.Tokens) > 0 {
+		authenticators = append(authenticators, CreateTokenAuth(conf.Tokens))
+	}
+	if len(conf.HMACKeys) > 0 {
+		authenticators = append(authenticators, CreateHMACAuth(conf.HMACKeys))
+	}
+
+	return CreateAuth(authenticators, conf.Policies, conf.Anonymous), nil
+}
+
+// Authenticate returns the caller and its policy.
+func (a *Auth) Authenticate(httpReq *http.Request) (*Identity, *Policy, error) {
+	for _, authenticator := range a.authenticators {
+		identity, err := authenticator.Authenticate(httpReq)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if identity == nil {
+			continue
+		}
+
+		policy, ok := a.policies[identity.Name]
+		if !ok {
+			policy = &Policy{}
+		}
+
+		return identity, policy, nil
+	}
+
+	if a.anonymous == nil {
+		return nil, nil, util.CreateUnauthenticatedErr("credentials required")
+	}
+
+	return &Identity{Name: "anonymous"}, a.anonymous, nil
+}
@@ -0,0 +1,5 @@
+package req
+
+type Balancer struct {
+	Strategy string `json:"strategy"`
+}
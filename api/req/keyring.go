@@ -0,0 +1,5 @@
+package req
+
+type Key struct {
+	Key string `json:"key"`
+}
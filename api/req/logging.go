@@ -0,0 +1,5 @@
+package req
+
+type LogLevel struct {
+	Level string `json:"level"`
+}
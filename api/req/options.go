@@ -0,0 +1,32 @@
+package req
+
+import (
+	"context"
+	"time"
+)
+
+type Options struct {
+	// Context of the API call, it carries the trace of the caller.
+	Context context.Context
+
+	Timeout time.Duration
+
+	// Idempotent requests may be retried even after they reached a member.
+	Idempotent bool
+
+	// RoutingKey pins requests with the same key to one member when the
+	// namespace balances by consistent hashing.
+	RoutingKey string
+
+	// Broadcast publishes to every member of each subscriber namespace
+	// instead of one member per namespace.
+	Broadcast bool
+
+	// Source is the namespace the message is sent on behalf of, it must be
+	// registered on this node. Empty sends on behalf of no service.
+	Source string
+
+	// Headers of the API call, subscription filters are evaluated on them.
+	// Credentials and X-DMP-* headers are left out.
+	Headers map[string]string
+}
@@ -3,4 +3,18 @@ package req
 type Service struct {
 	Namespace    string `json:"namespace"`
 	ContactPoint string `json:"contact-point"`
+	Check        *Check `json:"check,omitempty"`
+}
+
+// Check is the health check of a registered service, one of HTTP, TCP or
+// Script. A check with none of them GETs the contact point. Script names one
+// of the check scripts the node operator allowed, callers cannot run
+// commands of their own.
+type Check struct {
+	HTTP      string `json:"http,omitempty"`
+	TCP       string `json:"tcp,omitempty"`
+	Script    string `json:"script,omitempty"`
+	Interval  string `json:"interval,omitempty"`
+	Timeout   string `json:"timeout,omitempty"`
+	Threshold int    `json:"threshold,omitempty"`
 }
@@ -0,0 +1,8 @@
+package req
+
+// Subscription of a service registered on the node, Namespace may be left
+// empty when the node hosts a single service.
+type Subscription struct {
+	Namespace string `json:"namespace"`
+	Filter    string `json:"filter"`
+}
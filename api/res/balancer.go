@@ -0,0 +1,6 @@
+package res
+
+type Balancer struct {
+	Namespace string `json:"namespace"`
+	Strategy  string `json:"strategy"`
+}
@@ -0,0 +1,21 @@
+package res
+
+import (
+	"time"
+)
+
+type DeadLetters struct {
+	DeadLetters []*DeadLetter `json:"dead-letters"`
+}
+
+type DeadLetter struct {
+	ID          uint64    `json:"id"`
+	Namespace   string    `json:"namespace"`
+	Topic       string    `json:"topic,omitempty"`
+	Reason      string    `json:"reason"`
+	Attempts    int       `json:"attempts"`
+	FirstFailed time.Time `json:"first-failed"`
+	LastFailed  time.Time `json:"last-failed"`
+	Size        int       `json:"size"`
+	Body        string    `json:"body,omitempty"`
+}
@@ -0,0 +1,11 @@
+package res
+
+// Keyring is the gossip keyring of the cluster after a keyring operation,
+// Keys counts the nodes holding each key.
+type Keyring struct {
+	Keys      map[string]int    `json:"keys"`
+	Nodes     int               `json:"nodes"`
+	Responses int               `json:"responses"`
+	Errors    int               `json:"errors"`
+	Messages  map[string]string `json:"messages,omitempty"`
+}
@@ -0,0 +1,6 @@
+package res
+
+// LogLevels is the log level of every subsystem of the node.
+type LogLevels struct {
+	Levels map[string]string `json:"levels"`
+}
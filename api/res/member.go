@@ -5,7 +5,21 @@ type Members struct {
 }
 
 type Member struct {
-	IP        string `json:"ip"`
-	Status    string `json:"status"`
-	Namespace string `json:"namespace"`
+	IP        string   `json:"ip"`
+	Status    string   `json:"status"`
+	Namespace string   `json:"namespace"`
+	Breaker   *Breaker `json:"breaker,omitempty"`
+	Check     *Check   `json:"check,omitempty"`
+}
+
+type Check struct {
+	Check   string `json:"check"`
+	Healthy bool   `json:"healthy"`
+	Output  string `json:"output,omitempty"`
+}
+
+type Breaker struct {
+	State     string  `json:"state"`
+	Failures  int     `json:"failures"`
+	LatencyMs float64 `json:"latency-ms"`
 }
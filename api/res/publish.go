@@ -0,0 +1,21 @@
+package res
+
+type Publish struct {
+	Topic      string               `json:"topic"`
+	Broadcast  bool                 `json:"broadcast"`
+	Delivered  []string             `json:"delivered"`
+	Failed     []string             `json:"failed"`
+	Namespaces []*NamespaceDelivery `json:"namespaces"`
+}
+
+type NamespaceDelivery struct {
+	Namespace string              `json:"namespace"`
+	Delivered bool                `json:"delivered"`
+	Instances []*InstanceDelivery `json:"instances"`
+}
+
+type InstanceDelivery struct {
+	Addr      string `json:"addr"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
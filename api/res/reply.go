@@ -0,0 +1,6 @@
+package res
+
+type Reply struct {
+	Body    []byte `json:"-"`
+	Retries int    `json:"retries"`
+}
@@ -2,52 +2,78 @@ package comm
 
 import (
 	"container/list"
-	"log"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"time"
+
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/metrics"
 )
 
 type Handler interface {
-	Recv([]byte) ([]byte, error)
+	Recv(*Request) ([]byte, error)
 }
 
 type Bus struct {
 	connPool *list.List
-	listener *net.TCPListener
+	listener net.Listener
 	handler  Handler
+	conf     *Config
 
-	logger *log.Logger
-	close  bool
+	logger *slog.Logger
 
+	// closed and connPool are guarded by poolLock, conns counts the
+	// connections still served.
+	closed   bool
+	conns    sync.WaitGroup
 	poolLock sync.Mutex
 }
 
-func Listen(addr *net.TCPAddr) (*net.TCPListener, error) {
+// Listen on addr, or on a random port of its host when addr cannot be
+// listened on and fallback is set.
+func Listen(addr *net.TCPAddr, fallback bool) (*net.TCPListener, error) {
 	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		addr.Port = 0
-		l, err := net.ListenTCP("tcp", addr)
-		if err != nil {
-			return nil, err
-		}
-
+	if err == nil {
 		return l, nil
 	}
 
-	return l, nil
+	if !fallback {
+		return nil, fmt.Errorf("comm bus cannot listen on %s : %w", addr, err)
+	}
+
+	anyPort := *addr
+	anyPort.Port = 0
+
+	return net.ListenTCP("tcp", &anyPort)
 }
 
-func CreateBus(addr *net.TCPAddr, handler Handler, logger *log.Logger) (*Bus, error) {
-	ln, err := Listen(addr)
+func CreateBus(addr *net.TCPAddr, handler Handler, conf *Config, logger *slog.Logger) (*Bus, error) {
+	tcpLn, err := Listen(addr, conf.PortFallback)
 	if err != nil {
 		return nil, err
 	}
 
+	if port := tcpLn.Addr().(*net.TCPAddr).Port; addr.Port != 0 && port != addr.Port {
+		logger.Warn("Comm port is taken, listening on a random port", "wanted", addr.Port, "port", port)
+	}
+
+	var ln net.Listener = tcpLn
+	if conf.TLS != nil {
+		ln = tls.NewListener(tcpLn, conf.TLS.ServerConfig())
+	}
+
 	bus := &Bus{
 		connPool: list.New(),
 		handler:  handler,
+		conf:     conf,
 		listener: ln,
-		close:    false,
 		logger:   logger,
 	}
 
@@ -56,63 +82,139 @@ func CreateBus(addr *net.TCPAddr, handler Handler, logger *log.Logger) (*Bus, er
 
 func (b *Bus) Start() {
 	for {
-		if b.close {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if !b.isClosed() {
+				b.logger.Error("Error while accept connection", logging.ERROR_KEY, err)
+			}
 			break
 		}
 
-		conn, err := b.listener.AcceptTCP()
-		if err != nil {
-			b.logger.Println("[DMP][Error] ", err)
+		b.poolLock.Lock()
+		if b.closed {
+			b.poolLock.Unlock()
+			conn.Close()
 			break
 		}
+		b.conns.Add(1)
+		b.poolLock.Unlock()
+
+		go func(conn net.Conn) {
+			defer b.conns.Done()
+
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				if err := handshake(tlsConn); err != nil {
+					b.logger.Warn("TLS handshake failed", "peer", conn.RemoteAddr().String(), logging.ERROR_KEY, err)
+					conn.Close()
+					return
+				}
+			}
 
-		go func(conn *net.TCPConn) {
 			b.poolLock.Lock()
+			if b.closed {
+				b.poolLock.Unlock()
+				conn.Close()
+				return
+			}
 			ele := b.connPool.PushFront(conn)
 			b.poolLock.Unlock()
+			metrics.ConnectionOpened()
 
-			HandleReceive(conn, b.handler, b.logger)
+			HandleReceive(conn, b.handler, b.conf, b.logger)
 
 			b.poolLock.Lock()
 			b.connPool.Remove(ele)
 			b.poolLock.Unlock()
+			metrics.ConnectionClosed()
 		}(conn)
 	}
 }
 
-func (b *Bus) Stop() {
-	b.close = true
+func (b *Bus) isClosed() bool {
+	b.poolLock.Lock()
+	defer b.poolLock.Unlock()
+
+	return b.closed
+}
+
+// Stop takes no new connection nor request and waits until the requests
+// being handled are replied, or ctx is done, before the connections are
+// closed. A request whose body still streams when Stop is called fails.
+func (b *Bus) Stop(ctx context.Context) error {
+	b.poolLock.Lock()
+	b.closed = true
 	b.listener.Close()
 
+	// a connection reads no further request once its read deadline passed,
+	// the replies of the requests it already read are still written.
+	for e := b.connPool.Front(); e != nil; e = e.Next() {
+		e.Value.(net.Conn).SetReadDeadline(time.Now())
+	}
+	b.poolLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		b.conns.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	b.poolLock.Lock()
+	defer b.poolLock.Unlock()
+
 	for e := b.connPool.Front(); e != nil; e = e.Next() {
-		conn := e.Value.(*net.TCPConn)
-		conn.Close()
+		e.Value.(net.Conn).Close()
 	}
+
+	return ctx.Err()
 }
 
 func (b *Bus) BusAddr() *net.TCPAddr {
 	return b.listener.Addr().(*net.TCPAddr)
 }
 
-func HandleReceive(conn *net.TCPConn, handler Handler, logger *log.Logger) {
-	recv := CreateReceiver(conn, logger)
+func HandleReceive(conn net.Conn, handler Handler, conf *Config, logger *slog.Logger) {
+	recv := CreateReceiver(conn, conf, logger)
 	defer recv.Close()
 
-	msg, err := recv.Recv()
-	if err != nil {
-		logger.Println("[DMP][Error]", err)
-		return
-	}
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
 
-	res, err := handler.Recv(msg)
-	if err != nil {
-		logger.Println("[DMP][Error]", err)
-		return
-	}
+	for {
+		req, err := recv.RecvRequest()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+				logger.Error("Error while receive message", "peer", conn.RemoteAddr().String(), logging.ERROR_KEY, err)
+			}
+			return
+		}
 
-	err = recv.Send(res)
-	if err != nil {
-		logger.Println("[DMP][Error] ", err)
-		return
+		inflight.Add(1)
+		go func(req *Request) {
+			defer inflight.Done()
+			defer req.Close()
+
+			start := time.Now()
+			res, err := handler.Recv(req)
+			metrics.ObserveReceive(req.Namespace(), err, time.Since(start))
+
+			if err != nil {
+				logger.ErrorContext(req.Context(), "Error while handle message", logging.ERROR_KEY, err)
+
+				if err := recv.ReplyError(req, err); err != nil {
+					logger.ErrorContext(req.Context(), "Error while reply", logging.ERROR_KEY, err)
+				}
+				return
+			}
+
+			if err := recv.Reply(req, res); err != nil {
+				logger.ErrorContext(req.Context(), "Error while reply", logging.ERROR_KEY, err)
+			}
+		}(req)
 	}
 }
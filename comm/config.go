@@ -0,0 +1,84 @@
+package comm
+
+import (
+	"fmt"
+
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	DEFAULT_MAX_BODY_SIZE    = 4 * 1024 * 1024
+	DEFAULT_MAX_MESSAGE_SIZE = 64 * 1024 * 1024
+	DEFAULT_CHUNK_SIZE       = 1024 * 1024
+)
+
+type Config struct {
+	// Largest body accepted in a single frame, checked before allocation.
+	MaxBodySize int64
+
+	// Largest body joined back together from streamed frames, a body read
+	// as a stream by a handler is not bounded.
+	MaxMessageSize int64
+
+	// Bodies larger than ChunkSize are streamed across several frames.
+	ChunkSize int
+
+	// Certificates of mutual TLS between nodes, nil for plaintext.
+	TLS *CertReloader
+
+	// Listen on a random port when the bus port is taken instead of failing,
+	// other nodes learn the port through discovery.
+	PortFallback bool
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		MaxBodySize:    DEFAULT_MAX_BODY_SIZE,
+		MaxMessageSize: DEFAULT_MAX_MESSAGE_SIZE,
+		ChunkSize:      DEFAULT_CHUNK_SIZE,
+	}
+}
+
+func (c *Config) Merge(optionConf *Config) {
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = optionConf.MaxBodySize
+	}
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = optionConf.MaxMessageSize
+	}
+	if c.ChunkSize == 0 {
+		c.ChunkSize = optionConf.ChunkSize
+	}
+	if c.TLS == nil {
+		c.TLS = optionConf.TLS
+	}
+	if !c.PortFallback {
+		c.PortFallback = optionConf.PortFallback
+	}
+}
+
+// joinLimit returns the error of a streamed body that grew to size bytes,
+// nil while it is within limit.
+func joinLimit(limit int64, size int) error {
+	if int64(size) > limit {
+		return util.CreateInvalidProtocol(fmt.Sprintf("streamed message exceeds %d bytes", limit))
+	}
+
+	return nil
+}
+
+func (c *Config) maxMessageSize() int64 {
+	if c.MaxMessageSize <= 0 {
+		return DEFAULT_MAX_MESSAGE_SIZE
+	}
+
+	return c.MaxMessageSize
+}
+
+func (c *Config) chunkSize() int {
+	if c.ChunkSize <= 0 || int64(c.ChunkSize) > c.MaxBodySize {
+		return int(c.MaxBodySize)
+	}
+
+	return c.ChunkSize
+}
@@ -1,28 +1,126 @@
 package comm
 
 import (
+	"io"
 	"net"
+	"time"
 )
 
+type conduit interface {
+	Send(*Message) error
+	Recv() (*Message, error)
+	SetDeadline(time.Time) error
+	Close() error
+}
+
 type endpoint struct {
-	pipe *pipe
-	addr net.Addr
+	conn           conduit
+	addr           net.Addr
+	chunkSize      int
+	maxMessageSize int64
 }
 
-func createEndpoint(conn *net.TCPConn) *endpoint {
+func createEndpoint(conn net.Conn, conf *Config) *endpoint {
 	raddr := conn.RemoteAddr()
 	return &endpoint{
-		pipe: createPipe(conn),
-		addr: raddr,
+		conn:           createPipe(conn, conf),
+		addr:           raddr,
+		chunkSize:      conf.chunkSize(),
+		maxMessageSize: conf.maxMessageSize(),
+	}
+}
+
+func createStreamEndpoint(st *stream, conf *Config) *endpoint {
+	return &endpoint{
+		conn:           st,
+		addr:           st.session.addr,
+		chunkSize:      conf.chunkSize(),
+		maxMessageSize: conf.maxMessageSize(),
 	}
 }
 
 func (e *endpoint) Send(msg *Message) error {
-	return e.pipe.Send(msg)
+	if len(msg.Body) <= e.chunkSize {
+		return e.conn.Send(msg)
+	}
+
+	body := msg.Body
+	for first := true; len(body) > 0; first = false {
+		size := e.chunkSize
+		if len(body) < size {
+			size = len(body)
+		}
+
+		chunk := createChunk(msg, body[:size], first, len(body) == size)
+		if err := e.conn.Send(chunk); err != nil {
+			return err
+		}
+
+		body = body[size:]
+	}
+
+	return nil
+}
+
+func (e *endpoint) SendStream(msg *Message, r io.Reader) error {
+	buf := make([]byte, e.chunkSize)
+
+	for first := true; ; first = false {
+		n, err := io.ReadFull(r, buf)
+
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+
+		chunk := createChunk(msg, buf[:n], first, last)
+		if err := e.conn.Send(chunk); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
 }
 
+// Recv returns the next message with streamed bodies joined back together,
+// it must only be used when frames of other messages can't interleave.
 func (e *endpoint) Recv() (*Message, error) {
-	return e.pipe.Recv()
+	msg, err := e.conn.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	for msg.HasFlag(FLAG_STREAM) && !msg.HasFlag(FLAG_END) {
+		next, err := e.conn.Recv()
+		if err != nil {
+			msg.Free()
+			return nil, err
+		}
+
+		if err := joinLimit(e.maxMessageSize, len(msg.Body)+len(next.Body)); err != nil {
+			next.Free()
+			msg.Free()
+			return nil, err
+		}
+
+		msg.Body = append(msg.Body, next.Body...)
+		msg.Flags = next.Flags
+		next.Free()
+	}
+
+	msg.Flags &^= FLAG_STREAM | FLAG_END
+
+	return msg, nil
+}
+
+func (e *endpoint) SetDeadline(t time.Time) error {
+	return e.conn.SetDeadline(t)
+}
+
+func (e *endpoint) recvFrame() (*Message, error) {
+	return e.conn.Recv()
 }
 
 func (e *endpoint) RemoteAddr() net.Addr {
@@ -30,5 +128,28 @@ func (e *endpoint) RemoteAddr() net.Addr {
 }
 
 func (e *endpoint) Close() error {
-	return e.pipe.Close()
+	return e.conn.Close()
+}
+
+func createChunk(msg *Message, body []byte, first bool, last bool) *Message {
+	chunk := &Message{
+		Header: Header{
+			Version: msg.Version,
+			Kind:    msg.Kind,
+			Flags:   msg.Flags | FLAG_STREAM,
+			ID:      msg.ID,
+		},
+		Body:     body,
+		deadline: msg.deadline,
+	}
+
+	if first {
+		chunk.Meta = msg.Meta
+	}
+
+	if last {
+		chunk.Flags |= FLAG_END
+	}
+
+	return chunk
 }
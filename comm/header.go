@@ -0,0 +1,178 @@
+package comm
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/soulski/dmp/tracing"
+	"github.com/soulski/dmp/util"
+)
+
+/*
+
+	Frame layout (big-endian)
+
+	magic    uint16
+	version  uint8
+	kind     uint8
+	flags    uint16
+	id       uint64
+	metaSize uint32
+	bodySize uint64
+	meta     [metaSize]byte  repeated keyLen uint16, key, valueLen uint32, value
+	body     [bodySize]byte
+
+	Fields that are added later must go into flags or meta, receivers ignore
+	flag bits and meta keys they do not know. Anything that changes the
+	layout above must bump VERSION.
+
+*/
+
+const (
+	MAGIC   uint16 = 0xD3B0
+	VERSION uint8  = 1
+
+	FRAME_PREFIX_SIZE = 26
+	MAX_HEADER_SIZE   = 64 * 1024
+)
+
+type MessageKind uint8
+
+const (
+	KIND_REQUEST MessageKind = iota + 1
+	KIND_NOTIFY
+	KIND_REPLY
+	KIND_ACK
+	KIND_ERROR
+)
+
+var messageKindName = map[MessageKind]string{
+	KIND_REQUEST: "Request",
+	KIND_NOTIFY:  "Notify",
+	KIND_REPLY:   "Reply",
+	KIND_ACK:     "Ack",
+	KIND_ERROR:   "Error",
+}
+
+func (k MessageKind) String() string {
+	if name, ok := messageKindName[k]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Unknown(%d)", uint8(k))
+}
+
+const (
+	// Body is one chunk of a streamed message, more frames with the same ID follow.
+	FLAG_STREAM uint16 = 1 << iota
+	// Last chunk of a streamed message.
+	FLAG_END
+)
+
+const (
+	// Milliseconds the sender is still willing to wait for the reply.
+	META_TIMEOUT = "timeout"
+	// Class of failure carried by an error reply.
+	META_ERROR = "error"
+	// Namespace of the registered service the message is meant for.
+	META_NAMESPACE = "namespace"
+	// Name of the sending node.
+	META_SENDER = "sender"
+	// Namespace of the service the message comes from.
+	META_SOURCE = "source"
+	// Topic a published message was sent on.
+	META_TOPIC = "topic"
+	// ID correlating the logs of every node a call went through.
+	META_CORRELATION = "correlation"
+	// W3C trace context of the sender.
+	META_TRACEPARENT = tracing.TRACEPARENT
+	META_TRACESTATE  = tracing.TRACESTATE
+
+	ERROR_TIMEOUT   = "timeout"
+	ERROR_FORBIDDEN = "forbidden"
+)
+
+type Header struct {
+	Version uint8
+	Kind    MessageKind
+	Flags   uint16
+	ID      uint64
+	Meta    map[string]string
+}
+
+func (h *Header) SetMeta(key string, value string) {
+	if h.Meta == nil {
+		h.Meta = make(map[string]string)
+	}
+
+	h.Meta[key] = value
+}
+
+func (h *Header) GetMeta(key string) string {
+	return h.Meta[key]
+}
+
+func (h *Header) HasFlag(flag uint16) bool {
+	return h.Flags&flag == flag
+}
+
+func (h *Header) encodeMeta() ([]byte, error) {
+	size := 0
+	for key, value := range h.Meta {
+		size += 2 + len(key) + 4 + len(value)
+	}
+
+	if size > MAX_HEADER_SIZE {
+		return nil, util.CreateMsgTooLongErr(MAX_HEADER_SIZE, int64(size))
+	}
+
+	raw := make([]byte, 0, size)
+	for key, value := range h.Meta {
+		if len(key) > 0xFFFF {
+			return nil, util.CreateInvalidArgs("meta key", key)
+		}
+
+		raw = binary.BigEndian.AppendUint16(raw, uint16(len(key)))
+		raw = append(raw, key...)
+		raw = binary.BigEndian.AppendUint32(raw, uint32(len(value)))
+		raw = append(raw, value...)
+	}
+
+	return raw, nil
+}
+
+func decodeMeta(raw []byte) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	meta := make(map[string]string)
+
+	for len(raw) > 0 {
+		if len(raw) < 2 {
+			return nil, util.CreateInvalidProtocol("truncated meta key length")
+		}
+
+		keySize := int(binary.BigEndian.Uint16(raw))
+		raw = raw[2:]
+
+		if len(raw) < keySize+4 {
+			return nil, util.CreateInvalidProtocol("truncated meta key")
+		}
+
+		key := string(raw[:keySize])
+		raw = raw[keySize:]
+
+		valueSize := int(binary.BigEndian.Uint32(raw))
+		raw = raw[4:]
+
+		if len(raw) < valueSize {
+			return nil, util.CreateInvalidProtocol("truncated meta value")
+		}
+
+		meta[key] = string(raw[:valueSize])
+		raw = raw[valueSize:]
+	}
+
+	return meta, nil
+}
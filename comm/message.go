@@ -2,27 +2,26 @@ package comm
 
 import (
 	"sync/atomic"
+	"time"
 
 	"github.com/soulski/dmp/util"
 )
 
 var poolByte = util.CreateBytePool()
 
-const (
-	HEADER_SIZE = 4
-)
-
 type Message struct {
-	Header   []byte
+	Header
 	Body     []byte
 	refCount int32
 
+	deadline time.Time
+
 	cache bool
 }
 
 func ReqMessage(sz int) *Message {
 	return &Message{
-		Header: make([]byte, 0, HEADER_SIZE),
+		Header: Header{Version: VERSION},
 		Body:   make([]byte, 0, sz),
 		cache:  true,
 	}
@@ -45,7 +44,6 @@ func (m *Message) Free() {
 			return
 		}
 
-		//poolByte.Return(m.Header)
 		//poolByte.Return(m.Body)
 	}
 }
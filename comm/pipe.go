@@ -2,92 +2,140 @@ package comm
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 	"net"
-	"runtime/debug"
+	"sync"
+	"time"
 
+	"github.com/soulski/dmp/metrics"
 	"github.com/soulski/dmp/util"
 )
 
 type pipe struct {
-	conn *net.TCPConn
+	conn        net.Conn
+	maxBodySize int64
+
+	sendLock sync.Mutex
 }
 
-func createPipe(conn *net.TCPConn) *pipe {
+func createPipe(conn net.Conn, conf *Config) *pipe {
 	return &pipe{
-		conn: conn,
+		conn:        conn,
+		maxBodySize: conf.MaxBodySize,
 	}
 }
 
 func (p *pipe) Send(msg *Message) error {
-	msgSize := uint64(len(msg.Body))
-	headSize := uint64(len(msg.Header))
+	return p.sendWithID(msg.ID, msg)
+}
 
-	var err error
-	if err = binary.Write(p.conn, binary.BigEndian, headSize); err != nil {
+func (p *pipe) sendWithID(id uint64, msg *Message) error {
+	meta, err := msg.encodeMeta()
+	if err != nil {
 		return err
 	}
 
-	if err = binary.Write(p.conn, binary.BigEndian, msgSize); err != nil {
-		return err
-	}
+	metaSize := uint32(len(meta))
+	msgSize := uint64(len(msg.Body))
 
-	if _, err = p.conn.Write(msg.Header); err != nil {
-		return err
+	frame := make([]byte, FRAME_PREFIX_SIZE, FRAME_PREFIX_SIZE+uint64(metaSize)+msgSize)
+	binary.BigEndian.PutUint16(frame[0:2], MAGIC)
+	frame[2] = VERSION
+	frame[3] = byte(msg.Kind)
+	binary.BigEndian.PutUint16(frame[4:6], msg.Flags)
+	binary.BigEndian.PutUint64(frame[6:14], id)
+	binary.BigEndian.PutUint32(frame[14:18], metaSize)
+	binary.BigEndian.PutUint64(frame[18:26], msgSize)
+
+	frame = append(frame, meta...)
+	frame = append(frame, msg.Body...)
+
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	if !msg.deadline.IsZero() {
+		p.conn.SetWriteDeadline(msg.deadline)
+		defer p.conn.SetWriteDeadline(time.Time{})
 	}
 
-	if _, err = p.conn.Write(msg.Body); err != nil {
+	if _, err := p.conn.Write(frame); err != nil {
+		// A partly written frame leaves the connection unusable.
+		p.conn.Close()
 		return err
 	}
 
+	metrics.ObserveFrame(metrics.SENT, len(frame))
+
 	return nil
 }
 
 func (p *pipe) Recv() (*Message, error) {
 	var err error
-	var msgSize int64
-	var headSize int64
+	prefix := make([]byte, FRAME_PREFIX_SIZE)
 
-	if err = binary.Read(p.conn, binary.BigEndian, &headSize); err != nil {
-		debug.PrintStack()
+	if _, err = io.ReadFull(p.conn, prefix); err != nil {
 		return nil, err
 	}
 
-	if err = binary.Read(p.conn, binary.BigEndian, &msgSize); err != nil {
-		debug.PrintStack()
-		return nil, err
+	if magic := binary.BigEndian.Uint16(prefix[0:2]); magic != MAGIC {
+		return nil, util.CreateInvalidProtocol(fmt.Sprintf("bad frame magic 0x%04X", magic))
 	}
 
-	msg := ReqMessage(int(msgSize))
+	if version := prefix[2]; version != VERSION {
+		return nil, util.CreateInvalidProtocol(fmt.Sprintf("unsupported frame version %d", version))
+	}
 
-	msg.Header = msg.Header[0:headSize]
-	msg.Body = msg.Body[0:msgSize]
+	metaSize := binary.BigEndian.Uint32(prefix[14:18])
+	msgSize := binary.BigEndian.Uint64(prefix[18:26])
 
-	if headSize > HEADER_SIZE {
-		return nil, util.CreateMsgTooLongErr(0, headSize)
+	if metaSize > MAX_HEADER_SIZE {
+		return nil, util.CreateMsgTooLongErr(MAX_HEADER_SIZE, int64(metaSize))
 	}
 
-	if headSize != 0 {
-		if _, err = io.ReadFull(p.conn, msg.Header); err != nil {
+	if msgSize > math.MaxInt64 || int64(msgSize) > p.maxBodySize {
+		return nil, util.CreateMsgTooLongErr(p.maxBodySize, int64(msgSize))
+	}
+
+	msg := ReqMessage(int(msgSize))
+	msg.Kind = MessageKind(prefix[3])
+	msg.Flags = binary.BigEndian.Uint16(prefix[4:6])
+	msg.ID = binary.BigEndian.Uint64(prefix[6:14])
+
+	if metaSize != 0 {
+		meta := make([]byte, metaSize)
+		if _, err = io.ReadFull(p.conn, meta); err != nil {
 			msg.Free()
-			debug.PrintStack()
 			return nil, err
 		}
-	}
 
-	if msgSize < 0 {
-		return nil, util.CreateMsgTooLongErr(0, msgSize)
+		if msg.Meta, err = decodeMeta(meta); err != nil {
+			msg.Free()
+			return nil, err
+		}
 	}
 
+	msg.Body = msg.Body[0:msgSize]
+
 	if _, err = io.ReadFull(p.conn, msg.Body); err != nil {
 		msg.Free()
-		debug.PrintStack()
 		return nil, err
 	}
 
+	metrics.ObserveFrame(metrics.RECEIVED, FRAME_PREFIX_SIZE+int(metaSize)+int(msgSize))
+
 	return msg, nil
 }
 
+func (p *pipe) SetDeadline(t time.Time) error {
+	return p.conn.SetDeadline(t)
+}
+
+func (p *pipe) RemoteAddr() net.Addr {
+	return p.conn.RemoteAddr()
+}
+
 func (p *pipe) Close() error {
 	return p.conn.Close()
 }
@@ -0,0 +1,106 @@
+package comm
+
+import (
+	"net"
+	"sync"
+)
+
+type Pool struct {
+	conf     *Config
+	sessions map[string]*session
+	lock     sync.Mutex
+}
+
+func CreatePool(conf *Config) *Pool {
+	return &Pool{
+		conf:     conf,
+		sessions: make(map[string]*session),
+	}
+}
+
+func (p *Pool) session(addr *net.TCPAddr) (*session, error) {
+	key := addr.String()
+
+	p.lock.Lock()
+	s, ok := p.sessions[key]
+	p.lock.Unlock()
+
+	if ok && s.Alive() {
+		return s, nil
+	}
+
+	s, err := dialSession(addr, p.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if exists, ok := p.sessions[key]; ok && exists != s && exists.Alive() {
+		s.Close()
+		return exists, nil
+	}
+
+	p.sessions[key] = s
+
+	return s, nil
+}
+
+func (p *Pool) openEndpoint(addr *net.TCPAddr) (*endpoint, error) {
+	s, err := p.session(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := s.openStream()
+	if err != nil {
+		return nil, err
+	}
+
+	return createStreamEndpoint(st, p.conf), nil
+}
+
+func (p *Pool) Dial(addr *net.TCPAddr, rType ReqType) (*Sender, error) {
+	ep, err := p.openEndpoint(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return createSender(rType, []*endpoint{ep}), nil
+}
+
+func (p *Pool) MultiDial(addrs []*net.TCPAddr) (*Sender, error) {
+	eps := make([]*endpoint, 0, len(addrs))
+
+	for _, addr := range addrs {
+		ep, err := p.openEndpoint(addr)
+		if err != nil {
+			for _, opened := range eps {
+				opened.Close()
+			}
+
+			return nil, err
+		}
+
+		eps = append(eps, ep)
+	}
+
+	return createMultiSender(eps), nil
+}
+
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	for key, s := range p.sessions {
+		if cErr := s.Close(); cErr != nil {
+			err = cErr
+		}
+
+		delete(p.sessions, key)
+	}
+
+	return err
+}
@@ -1,21 +1,9 @@
 package comm
 
 import (
-	"github.com/soulski/dmp/util"
-)
-
-const (
-	CONN_TYPE_INDEX = 0
-
-	SYNC_FLAG  string = "0"
-	ASYNC_FLAG string = "1"
-)
-
-type ConnType uint8
+	"io"
 
-const (
-	SYNC_CONN = iota
-	ASYNC_CONN
+	"github.com/soulski/dmp/util"
 )
 
 type Protocol interface {
@@ -26,6 +14,10 @@ type Protocol interface {
 	Send(*Message) error
 }
 
+type StreamProtocol interface {
+	SendStream(*Message, io.Reader) error
+}
+
 /*
 
 	Sender Protocol
@@ -45,13 +37,17 @@ func (r *Req) AddEndpoint(ep *endpoint) {
 }
 
 func (r *Req) Send(msg *Message) error {
-	sync := []byte(SYNC_FLAG)
-	msg.Header = append(msg.Header, sync...)
+	msg.Kind = KIND_REQUEST
 	return r.ep.Send(msg)
 }
 
+func (r *Req) SendStream(msg *Message, body io.Reader) error {
+	msg.Kind = KIND_REQUEST
+	return r.ep.SendStream(msg, body)
+}
+
 func (r *Req) Recv() (*Message, error) {
-	return r.ep.Recv()
+	return recvReply(r.ep)
 }
 
 func (r *Req) RemoveEndpoint(ep *endpoint) {}
@@ -74,51 +70,55 @@ func (m *Multi) RemoveEndpoint(ep *endpoint) {
 
 }
 
+type multiAck struct {
+	addr string
+	err  error
+}
+
 func (m *Multi) Send(msg *Message) error {
-	ackCh := make(chan string)
+	ackCh := make(chan multiAck)
 	ackNum := len(m.eps)
 
-	async := []byte(ASYNC_FLAG)
-	msg.Header = append(msg.Header, async...)
+	msg.Kind = KIND_NOTIFY
 
 	defer close(ackCh)
 
 	for _, ep := range m.eps {
-		go func(ep *endpoint, ackCh chan string) {
+		go func(ep *endpoint, ackCh chan multiAck) {
 			var err error
 			var rMsg *Message
 
 			sMsg := msg.Dup()
 			defer sMsg.Free()
 
+			addr := ep.RemoteAddr().String()
+
 			if err = ep.Send(sMsg); err != nil {
-				ackCh <- ep.RemoteAddr().String()
+				ackCh <- multiAck{addr, err}
 				return
 			}
 
-			if rMsg, err = ep.Recv(); err != nil {
-				ackCh <- ep.RemoteAddr().String()
+			if rMsg, err = recvReply(ep); err != nil {
+				ackCh <- multiAck{addr, err}
 				return
 			} else {
 				rMsg.Free()
 			}
 
-			ackCh <- ""
+			ackCh <- multiAck{addr, nil}
 		}(ep, ackCh)
 	}
 
-	allRecv := true
-	failNodes := []string{}
+	failNodes := map[string]error{}
 
 	for index := 0; index < ackNum; index++ {
 		ack := <-ackCh
-		if ack != "" {
-			failNodes = append(failNodes, ack)
-			allRecv = false
+		if ack.err != nil {
+			failNodes[ack.addr] = ack.err
 		}
 	}
 
-	if !allRecv {
+	if len(failNodes) > 0 {
 		return util.CreateIncompleteMultiErr(failNodes)
 	}
 
@@ -142,13 +142,17 @@ func (r *Noti) AddEndpoint(ep *endpoint) {
 }
 
 func (r *Noti) Send(msg *Message) error {
-	sync := []byte(ASYNC_FLAG)
-	msg.Header = append(msg.Header, sync...)
+	msg.Kind = KIND_NOTIFY
 	return r.ep.Send(msg)
 }
 
+func (r *Noti) SendStream(msg *Message, body io.Reader) error {
+	msg.Kind = KIND_NOTIFY
+	return r.ep.SendStream(msg, body)
+}
+
 func (r *Noti) Recv() (*Message, error) {
-	return r.ep.Recv()
+	return recvReply(r.ep)
 }
 
 func (r *Noti) RemoveEndpoint(ep *endpoint) {}
@@ -160,8 +164,7 @@ func (r *Noti) RemoveEndpoint(ep *endpoint) {}
 */
 
 type Res struct {
-	ep       *endpoint
-	connType ConnType
+	ep *endpoint
 }
 
 func CreateRes() *Res {
@@ -172,50 +175,56 @@ func (r *Res) AddEndpoint(ep *endpoint) {
 	r.ep = ep
 }
 
+// Recv returns single frames, chunks of a streamed message are handed out as
+// they arrive. Async messages are acked by the receiver once its handler
+// accepted them, not when they are read.
 func (r *Res) Recv() (*Message, error) {
-	msg, err := r.ep.Recv()
+	msg, err := r.ep.recvFrame()
 	if err != nil {
 		return nil, err
 	}
 
-	header := string(msg.Header)
-	if header == ASYNC_FLAG {
-		r.connType = ASYNC_CONN
-	} else {
-		r.connType = SYNC_CONN
+	switch msg.Kind {
+	case KIND_NOTIFY, KIND_REQUEST:
+		return msg, nil
 	}
 
-	switch r.connType {
-	case ASYNC_CONN:
-		return r.asynRecv(msg)
-	case SYNC_CONN:
-		r.connType = SYNC_CONN
-		return r.syncRecv(msg)
-	}
+	msg.Free()
+	return nil, util.CreateInvalidProtocol("Unexpected message kind " + msg.Kind.String())
+}
 
-	return nil, util.CreateInvalidProtocol("Unknow connection type flag")
+func (r *Res) Send(msg *Message) error {
+	return r.ep.Send(msg)
 }
 
-func (r *Res) asynRecv(recvMsg *Message) (*Message, error) {
-	reply := []byte("ACKS")
-	sMsg := CreateMessage(reply)
-	defer sMsg.Free()
+func (r *Res) RemoveEndpoint(ep *endpoint) {}
 
-	return recvMsg, r.ep.Send(sMsg)
+func isAsync(msg *Message) bool {
+	return msg.Kind == KIND_NOTIFY
 }
 
-func (r *Res) syncRecv(recvMsg *Message) (*Message, error) {
-	return recvMsg, nil
-}
-func (r *Res) Send(msg *Message) error {
-	switch r.connType {
-	case ASYNC_CONN:
-		return nil
-	case SYNC_CONN:
-		return r.ep.Send(msg)
+func recvReply(ep *endpoint) (*Message, error) {
+	msg, err := ep.Recv()
+	if err != nil {
+		return nil, err
 	}
 
-	return util.CreateInvalidProtocol("Unknow connection type flag")
-}
+	switch msg.Kind {
+	case KIND_REPLY, KIND_ACK:
+		return msg, nil
+	case KIND_ERROR:
+		defer msg.Free()
+
+		switch msg.GetMeta(META_ERROR) {
+		case ERROR_TIMEOUT:
+			return nil, util.CreateRemoteTimeoutErr(string(msg.Body))
+		case ERROR_FORBIDDEN:
+			return nil, util.CreateRemoteForbiddenErr(string(msg.Body))
+		}
 
-func (r *Res) RemoveEndpoint(ep *endpoint) {}
+		return nil, util.CreateRemoteErr(string(msg.Body))
+	}
+
+	msg.Free()
+	return nil, util.CreateInvalidProtocol("Unexpected reply kind " + msg.Kind.String())
+}
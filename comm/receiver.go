@@ -1,47 +1,188 @@
 package comm
 
 import (
+	"bytes"
 	"encoding/json"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+
+	"github.com/soulski/dmp/util"
 )
 
 type Receiver struct {
 	proto Protocol
 	eps   []*endpoint
 
-	logger *log.Logger
+	streams map[uint64]*io.PipeWriter
+
+	lastID    uint64
+	lastAsync bool
+
+	maxMessageSize int64
+
+	// subject of the peer certificate, empty without TLS.
+	peer string
+
+	logger *slog.Logger
 }
 
-func CreateReceiver(conn *net.TCPConn, logger *log.Logger) *Receiver {
-	ep := createEndpoint(conn)
+func CreateReceiver(conn net.Conn, conf *Config, logger *slog.Logger) *Receiver {
+	ep := createEndpoint(conn, conf)
 
 	res := CreateRes()
 	res.AddEndpoint(ep)
 
 	return &Receiver{
-		proto:  res,
-		logger: logger,
-		eps:    []*endpoint{ep},
+		proto:   res,
+		logger:  logger,
+		eps:     []*endpoint{ep},
+		streams: make(map[uint64]*io.PipeWriter),
+		peer:    PeerSubject(conn),
+
+		maxMessageSize: conf.maxMessageSize(),
+	}
+}
+
+// RecvRequest returns the next new request on the connection. Chunks of
+// streamed requests are written to the body of the request they belong to,
+// so RecvRequest blocks until the handler reading that body catches up.
+func (r *Receiver) RecvRequest() (*Request, error) {
+	for {
+		msg, err := r.proto.Recv()
+		if err != nil {
+			r.abortStreams(err)
+			return nil, err
+		}
+
+		if w, ok := r.streams[msg.ID]; ok {
+			r.feedStream(msg.ID, w, msg)
+			continue
+		}
+
+		req := createRequest(msg, r.eps[0].RemoteAddr(), r.peer)
+
+		if msg.HasFlag(FLAG_STREAM) && !msg.HasFlag(FLAG_END) {
+			pr, pw := io.Pipe()
+
+			req.Body = io.MultiReader(bytes.NewReader(msg.Body), pr)
+			req.Size = -1
+			req.stream = pr
+
+			r.streams[msg.ID] = pw
+		}
+
+		return req, nil
+	}
+}
+
+func (r *Receiver) feedStream(id uint64, w *io.PipeWriter, msg *Message) {
+	defer msg.Free()
+
+	if w != nil {
+		if _, err := w.Write(msg.Body); err != nil {
+			// Handler stopped reading, drop the rest of the stream.
+			r.streams[id] = nil
+		}
+	}
+
+	if msg.HasFlag(FLAG_END) {
+		if w != nil {
+			w.Close()
+		}
+
+		delete(r.streams, id)
 	}
 }
 
+func (r *Receiver) abortStreams(cause error) {
+	for id, w := range r.streams {
+		if w != nil {
+			w.CloseWithError(cause)
+		}
+
+		delete(r.streams, id)
+	}
+}
+
+// Reply answers a request with content, an async request only gets the ack.
+func (r *Receiver) Reply(req *Request, content []byte) error {
+	if req.IsAsync() {
+		return r.ack(req.ID)
+	}
+
+	msg := CreateMessage(content)
+	msg.Kind = KIND_REPLY
+	msg.ID = req.ID
+	defer msg.Free()
+
+	return r.proto.Send(msg)
+}
+
+func (r *Receiver) ack(id uint64) error {
+	msg := CreateMessage([]byte("ACKS"))
+	msg.Kind = KIND_ACK
+	msg.ID = id
+	defer msg.Free()
+
+	return r.proto.Send(msg)
+}
+
+func (r *Receiver) ReplyError(req *Request, cause error) error {
+	msg := CreateMessage([]byte(cause.Error()))
+	msg.Kind = KIND_ERROR
+	msg.ID = req.ID
+	defer msg.Free()
+
+	if util.IsTimeout(cause) {
+		msg.SetMeta(META_ERROR, ERROR_TIMEOUT)
+	} else if util.IsForbidden(cause) {
+		msg.SetMeta(META_ERROR, ERROR_FORBIDDEN)
+	}
+
+	return r.proto.Send(msg)
+}
+
 func (r *Receiver) Recv() ([]byte, error) {
 	msg, err := r.proto.Recv()
 	if err != nil {
 		return nil, err
 	}
 
+	r.lastID = msg.ID
+	r.lastAsync = isAsync(msg)
+
 	rMsg := make([]byte, 0, len(msg.Body))
 	rMsg = append(rMsg, msg.Body...)
 
+	for msg.HasFlag(FLAG_STREAM) && !msg.HasFlag(FLAG_END) {
+		msg.Free()
+
+		if msg, err = r.proto.Recv(); err != nil {
+			return nil, err
+		}
+
+		if err := joinLimit(r.maxMessageSize, len(rMsg)+len(msg.Body)); err != nil {
+			msg.Free()
+			return nil, err
+		}
+
+		rMsg = append(rMsg, msg.Body...)
+	}
+
 	msg.Free()
 
 	return rMsg, err
 }
 
 func (r *Receiver) Send(content []byte) error {
+	if r.lastAsync {
+		return r.ack(r.lastID)
+	}
+
 	msg := CreateMessage(content)
+	msg.Kind = KIND_REPLY
+	msg.ID = r.lastID
 	defer msg.Free()
 
 	return r.proto.Send(msg)
@@ -0,0 +1,156 @@
+package comm
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/tracing"
+	"github.com/soulski/dmp/util"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type Request struct {
+	ID         uint64
+	Kind       MessageKind
+	Meta       map[string]string
+	RemoteAddr net.Addr
+
+	// Peer is the certificate subject of the sending node, empty when the
+	// comm bus runs without TLS.
+	Peer string
+
+	// Body is fully buffered unless the sender streamed it, in which case
+	// chunks are read from the connection as Body is consumed and Size is -1.
+	Body io.Reader
+	Size int64
+
+	stream *io.PipeReader
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func createRequest(msg *Message, raddr net.Addr, peer string) *Request {
+	req := &Request{
+		ID:         msg.ID,
+		Kind:       msg.Kind,
+		Meta:       msg.Meta,
+		RemoteAddr: raddr,
+		Peer:       peer,
+		Body:       bytes.NewReader(msg.Body),
+		Size:       int64(len(msg.Body)),
+	}
+
+	// Async work outlives the sender's wait for the ack, only a request
+	// whose sender is blocked on the reply is abandoned at its deadline.
+	ctx := tracing.Extract(context.Background(), propagation.MapCarrier(msg.Meta))
+	ctx = logging.WithCorrelation(ctx, msg.GetMeta(META_CORRELATION))
+	ctx = withMessageFields(ctx, msg)
+
+	timeout, err := strconv.ParseInt(msg.GetMeta(META_TIMEOUT), 10, 64)
+	if err == nil && !req.IsAsync() {
+		req.ctx, req.cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	} else {
+		req.ctx, req.cancel = context.WithCancel(ctx)
+	}
+
+	return req
+}
+
+// withMessageFields adds the namespace and topic of msg to the records
+// logged with ctx.
+func withMessageFields(ctx context.Context, msg *Message) context.Context {
+	fields := []any{}
+
+	if ns := msg.GetMeta(META_NAMESPACE); ns != "" {
+		fields = append(fields, "namespace", ns)
+	}
+
+	if topic := msg.GetMeta(META_TOPIC); topic != "" {
+		fields = append(fields, "topic", topic)
+	}
+
+	if len(fields) == 0 {
+		return ctx
+	}
+
+	return logging.WithFields(ctx, fields...)
+}
+
+func (r *Request) GetMeta(key string) string {
+	return r.Meta[key]
+}
+
+// Namespace is the registered service the request is meant for, empty when
+// the sender did not address one.
+func (r *Request) Namespace() string {
+	return r.Meta[META_NAMESPACE]
+}
+
+// Sender is the name the sending node gave itself, unlike Peer it is not
+// verified.
+func (r *Request) Sender() string {
+	return r.Meta[META_SENDER]
+}
+
+// Source is the namespace of the service the request comes from, empty when
+// it was sent on behalf of no service.
+func (r *Request) Source() string {
+	return r.Meta[META_SOURCE]
+}
+
+// Topic is the topic of a published message, empty for other messages.
+func (r *Request) Topic() string {
+	return r.Meta[META_TOPIC]
+}
+
+func (r *Request) IsAsync() bool {
+	return r.Kind == KIND_NOTIFY
+}
+
+func (r *Request) IsStream() bool {
+	return r.stream != nil
+}
+
+// Context is done once the sender stops waiting for the reply or the
+// request is closed, it carries the trace context of the sender.
+func (r *Request) Context() context.Context {
+	return r.ctx
+}
+
+func (r *Request) ReadBody() ([]byte, error) {
+	return ioutil.ReadAll(r.Body)
+}
+
+// ReadBodyLimit reads the body, failing once it passes limit bytes. A
+// streamed body is read no further than that.
+func (r *Request) ReadBodyLimit(limit int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > limit {
+		return nil, util.CreateMsgTooLongErr(limit, int64(len(body)))
+	}
+
+	return body, nil
+}
+
+// Close releases the rest of a streamed body, frames still arriving for the
+// request are dropped by the receiver.
+func (r *Request) Close() error {
+	r.cancel()
+
+	if r.stream != nil {
+		return r.stream.Close()
+	}
+
+	return nil
+}
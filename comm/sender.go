@@ -1,8 +1,17 @@
 package comm
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"net"
+	"strconv"
+	"time"
+
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/tracing"
+	"github.com/soulski/dmp/util"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 type ReqType int
@@ -15,6 +24,17 @@ const (
 type Sender struct {
 	proto Protocol
 	eps   []*endpoint
+
+	deadline  time.Time
+	namespace string
+
+	// identity of the message, carried in the meta of every frame.
+	sender string
+	source string
+	topic  string
+	trace  propagation.MapCarrier
+
+	correlation string
 }
 
 func Dial(url string) (*Sender, error) {
@@ -36,6 +56,12 @@ func DialWithType(addr *net.TCPAddr, rType ReqType) (*Sender, error) {
 		return nil, err
 	}
 
+	ep := createEndpoint(conn, DefaultConfig())
+
+	return createSender(rType, []*endpoint{ep}), nil
+}
+
+func createSender(rType ReqType, eps []*endpoint) *Sender {
 	var proto Protocol
 
 	switch rType {
@@ -45,17 +71,30 @@ func DialWithType(addr *net.TCPAddr, rType ReqType) (*Sender, error) {
 		proto = CreateNoti()
 	}
 
-	ep := createEndpoint(conn)
-	proto.AddEndpoint(ep)
+	for _, ep := range eps {
+		proto.AddEndpoint(ep)
+	}
 
 	return &Sender{
 		proto: proto,
-		eps:   []*endpoint{ep},
-	}, nil
+		eps:   eps,
+	}
+}
+
+func createMultiSender(eps []*endpoint) *Sender {
+	multi := CreateMulti()
+	for _, ep := range eps {
+		multi.AddEndpoint(ep)
+	}
+
+	return &Sender{
+		proto: multi,
+		eps:   eps,
+	}
 }
 
 func MultiDial(urls []string) (*Sender, error) {
-	addrs := make([]*net.TCPAddr, len(urls))
+	addrs := make([]*net.TCPAddr, 0, len(urls))
 	for _, url := range urls {
 		addr, err := net.ResolveTCPAddr("tcp", url)
 		if err != nil {
@@ -69,34 +108,136 @@ func MultiDial(urls []string) (*Sender, error) {
 }
 
 func MultiDialAddr(addrs []*net.TCPAddr) (*Sender, error) {
-	multi := CreateMulti()
 	eps := make([]*endpoint, 0, len(addrs))
 
 	for _, addr := range addrs {
 		conn, err := net.DialTCP("tcp", nil, addr)
 		if err != nil {
+			for _, ep := range eps {
+				ep.Close()
+			}
+
 			return nil, err
 		}
 
-		ep := createEndpoint(conn)
-		eps = append(eps, ep)
+		eps = append(eps, createEndpoint(conn, DefaultConfig()))
+	}
 
-		multi.AddEndpoint(ep)
+	return createMultiSender(eps), nil
+}
+
+// SetDeadline bounds sending and waiting for the reply, the time left is
+// carried with each message so the receiving node can give up as well.
+func (s *Sender) SetDeadline(t time.Time) error {
+	s.deadline = t
+
+	for _, ep := range s.eps {
+		if err := ep.SetDeadline(t); err != nil {
+			return err
+		}
 	}
 
-	return &Sender{
-		proto: multi,
-		eps:   eps,
-	}, nil
+	return nil
+}
+
+func (s *Sender) SetTimeout(timeout time.Duration) error {
+	return s.SetDeadline(time.Now().Add(timeout))
+}
+
+// SetNamespace addresses messages to one of the services registered on the
+// receiving node.
+func (s *Sender) SetNamespace(ns string) {
+	s.namespace = ns
+}
+
+// SetSource tells the receiving node which node and service the messages
+// come from, source is empty when sent on behalf of no service.
+func (s *Sender) SetSource(sender string, source string) {
+	s.sender = sender
+	s.source = source
+}
+
+// SetTopic marks the messages as published on topic.
+func (s *Sender) SetTopic(topic string) {
+	s.topic = topic
+}
+
+// SetTrace carries the trace context and the correlation ID of ctx to the
+// receiving node, where they are in the request context.
+func (s *Sender) SetTrace(ctx context.Context) {
+	s.trace = propagation.MapCarrier{}
+	tracing.Inject(ctx, s.trace)
+
+	s.correlation = logging.CorrelationID(ctx)
+}
+
+func (s *Sender) prepare(msg *Message) error {
+	if s.namespace != "" {
+		msg.SetMeta(META_NAMESPACE, s.namespace)
+	}
+
+	if s.sender != "" {
+		msg.SetMeta(META_SENDER, s.sender)
+	}
+
+	if s.source != "" {
+		msg.SetMeta(META_SOURCE, s.source)
+	}
+
+	if s.topic != "" {
+		msg.SetMeta(META_TOPIC, s.topic)
+	}
+
+	for key, value := range s.trace {
+		msg.SetMeta(key, value)
+	}
+
+	if s.correlation != "" {
+		msg.SetMeta(META_CORRELATION, s.correlation)
+	}
+
+	if s.deadline.IsZero() {
+		return nil
+	}
+
+	left := time.Until(s.deadline)
+	if left <= 0 {
+		return util.CreateTimeoutErr("Send", 0)
+	}
+
+	msg.deadline = s.deadline
+	msg.SetMeta(META_TIMEOUT, strconv.FormatInt(int64(left/time.Millisecond), 10))
+
+	return nil
 }
 
 func (s *Sender) Send(content []byte) error {
 	msg := CreateMessage(content)
 	defer msg.Free()
 
+	if err := s.prepare(msg); err != nil {
+		return err
+	}
+
 	return s.proto.Send(msg)
 }
 
+func (s *Sender) SendStream(body io.Reader) error {
+	proto, ok := s.proto.(StreamProtocol)
+	if !ok {
+		return util.CreateInvalidProtocol("Protocol doesn't support streaming body")
+	}
+
+	msg := ReqMessage(0)
+	defer msg.Free()
+
+	if err := s.prepare(msg); err != nil {
+		return err
+	}
+
+	return proto.SendStream(msg, body)
+}
+
 func (s *Sender) Recv() ([]byte, error) {
 	msg, err := s.proto.Recv()
 	if err != nil {
@@ -0,0 +1,210 @@
+package comm
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/soulski/dmp/metrics"
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	STREAM_BUFFER_SIZE = 1
+)
+
+/*
+
+	Session is a long-lived connection to a peer shared by many in-flight
+	requests. Every request opens its own stream which owns a request ID,
+	frames coming back from the peer are routed to the stream by that ID.
+
+*/
+
+type session struct {
+	pipe *pipe
+	addr net.Addr
+
+	streams map[uint64]*stream
+	lastID  uint64
+	lock    sync.Mutex
+
+	broken chan struct{}
+	err    error
+}
+
+func dialSession(addr *net.TCPAddr, conf *Config) (*session, error) {
+	conn, err := dial(addr, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		pipe:    createPipe(conn, conf),
+		addr:    conn.RemoteAddr(),
+		streams: make(map[uint64]*stream),
+		broken:  make(chan struct{}),
+	}
+
+	go s.readLoop()
+
+	return s, nil
+}
+
+// dial opens a connection to a peer, over mutual TLS when configured.
+func dial(addr *net.TCPAddr, conf *Config) (net.Conn, error) {
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		metrics.DialError("connect")
+		return nil, err
+	}
+
+	if conf.TLS == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, conf.TLS.ClientConfig())
+	if err := handshake(tlsConn); err != nil {
+		metrics.DialError("handshake")
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func (s *session) openStream() (*stream, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	s.lastID++
+
+	st := &stream{
+		id:      s.lastID,
+		session: s,
+		recvCh:  make(chan *Message, STREAM_BUFFER_SIZE),
+		done:    make(chan struct{}),
+	}
+	s.streams[st.id] = st
+
+	return st, nil
+}
+
+func (s *session) closeStream(st *stream) {
+	s.lock.Lock()
+	delete(s.streams, st.id)
+	s.lock.Unlock()
+}
+
+func (s *session) readLoop() {
+	for {
+		msg, err := s.pipe.Recv()
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+
+		s.lock.Lock()
+		st, ok := s.streams[msg.ID]
+		s.lock.Unlock()
+
+		if !ok {
+			msg.Free()
+			continue
+		}
+
+		st.deliver(msg)
+	}
+}
+
+func (s *session) shutdown(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil {
+		return
+	}
+
+	s.err = err
+	close(s.broken)
+	s.pipe.Close()
+}
+
+func (s *session) Alive() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err == nil
+}
+
+func (s *session) Close() error {
+	s.shutdown(net.ErrClosed)
+	return nil
+}
+
+type stream struct {
+	id       uint64
+	session  *session
+	deadline time.Time
+	timeout  time.Duration
+
+	recvCh chan *Message
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (st *stream) deliver(msg *Message) {
+	select {
+	case st.recvCh <- msg:
+	case <-st.done:
+		msg.Free()
+	}
+}
+
+func (st *stream) Send(msg *Message) error {
+	return st.session.pipe.sendWithID(st.id, msg)
+}
+
+func (st *stream) SetDeadline(t time.Time) error {
+	st.deadline = t
+	st.timeout = time.Until(t)
+	return nil
+}
+
+func (st *stream) Recv() (*Message, error) {
+	var timeout <-chan time.Time
+	if !st.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(st.deadline))
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case msg := <-st.recvCh:
+		return msg, nil
+	case <-timeout:
+		return nil, util.CreateTimeoutErr("Recv from "+st.session.addr.String(), st.timeout)
+	case <-st.session.broken:
+		select {
+		case msg := <-st.recvCh:
+			return msg, nil
+		default:
+			return nil, st.session.err
+		}
+	}
+}
+
+func (st *stream) Close() error {
+	st.once.Do(func() {
+		st.session.closeStream(st)
+		close(st.done)
+	})
+
+	return nil
+}
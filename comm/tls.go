@@ -0,0 +1,250 @@
+package comm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	DEFAULT_CERT_RELOAD_INTERVAL = 10 * time.Second
+	DEFAULT_HANDSHAKE_TIMEOUT    = 10 * time.Second
+)
+
+/*
+
+	CertReloader holds the certificate of this node and the CA peers are
+	verified against, both loaded from files. The files are checked every
+	interval and loaded again once changed, connections opened afterwards
+	use the new ones. Either side of a connection presents its certificate
+	and verifies the peer's one, peers are dialed by address so only the
+	chain is verified and not the host name.
+
+*/
+
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime map[string]time.Time
+	lock    sync.RWMutex
+
+	stopCh chan struct{}
+	once   sync.Once
+	logger *slog.Logger
+}
+
+func CreateCertReloader(certFile string, keyFile string, caFile string, interval time.Duration, logger *slog.Logger) (*CertReloader, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, util.CreateInvalidArgs("tls", "certificate, key and CA files are all required")
+	}
+
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		modTime:  make(map[string]time.Time),
+		stopCh:   make(chan struct{}),
+		logger:   logger,
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go r.watch(interval)
+	}
+
+	return r, nil
+}
+
+func (r *CertReloader) load() error {
+	modTime := make(map[string]time.Time, 3)
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		modTime[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	ca, err := ioutil.ReadFile(r.caFile)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return util.CreateInvalidArgs("tls-ca", r.caFile)
+	}
+
+	r.lock.Lock()
+	r.cert = &cert
+	r.pool = pool
+	r.modTime = modTime
+	r.lock.Unlock()
+
+	return nil
+}
+
+func (r *CertReloader) changed() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for file, modTime := range r.modTime {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch keeps the certificates in use while new files fail to load, a
+// renewal written file by file is picked up once complete.
+func (r *CertReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stopCh:
+			return
+		}
+
+		if !r.changed() {
+			continue
+		}
+
+		if err := r.load(); err != nil {
+			r.logger.Warn("Error while reload certificates", "cert", r.certFile, logging.ERROR_KEY, err)
+			continue
+		}
+
+		r.logger.Info("Certificates reloaded", "cert", r.certFile)
+	}
+}
+
+func (r *CertReloader) certificate() (*tls.Certificate, *x509.CertPool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.cert, r.pool
+}
+
+// ServerConfig requires and verifies the certificate of every peer.
+func (r *CertReloader) ServerConfig() *tls.Config {
+	return r.ServerConfigAuth(tls.RequireAndVerifyClientCert)
+}
+
+// ServerConfigAuth serves the node certificate and handles client
+// certificates as clientAuth says.
+func (r *CertReloader) ServerConfigAuth(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.certificate()
+			return cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.certificate()
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   clientAuth,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig presents the node certificate and verifies the chain of the
+// peer against the current CA.
+func (r *CertReloader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.certificate()
+			return cert, nil
+		},
+		// verified in VerifyConnection without the host name.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, pool := r.certificate()
+			return verifyChain(state.PeerCertificates, pool)
+		},
+	}
+}
+
+func (r *CertReloader) Close() error {
+	r.once.Do(func() {
+		close(r.stopCh)
+	})
+
+	return nil
+}
+
+func verifyChain(certs []*x509.Certificate, pool *x509.CertPool) error {
+	if len(certs) == 0 {
+		return util.CreateInvalidProtocol("peer presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+
+	return err
+}
+
+// handshake completes the TLS handshake of a connection before it is used,
+// so a peer failing it is dropped at once.
+func handshake(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(DEFAULT_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	return conn.Handshake()
+}
+
+// PeerSubject is the subject of the certificate the peer presented, empty
+// on a plaintext connection.
+func PeerSubject(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+
+	return certs[0].Subject.String()
+}
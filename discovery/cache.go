@@ -0,0 +1,249 @@
+package discovery
+
+import (
+	"sort"
+	"sync"
+)
+
+// watchers get a snapshot of the namespace on every change, a snapshot not
+// read yet is replaced by the newer one.
+type watcher struct {
+	ch chan []*Service
+}
+
+/*
+
+	serviceCache holds the services of every member, indexed by namespace and
+	by subscribed topic pattern. It is updated from Serf member events so
+	reads do not walk the member list.
+
+*/
+
+type serviceCache struct {
+	members     map[string][]*Service
+	byNamespace map[string]map[string]*Service
+	byPattern   map[string]map[*Service]bool
+
+	watchers map[string]map[*watcher]bool
+
+	lock sync.RWMutex
+}
+
+func createServiceCache() *serviceCache {
+	return &serviceCache{
+		members:     make(map[string][]*Service),
+		byNamespace: make(map[string]map[string]*Service),
+		byPattern:   make(map[string]map[*Service]bool),
+		watchers:    make(map[string]map[*watcher]bool),
+	}
+}
+
+// update replaces the services of a member and notifies watchers of every
+// namespace it had or has.
+func (c *serviceCache) update(name string, services []*Service) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	changed := c.removeLocked(name)
+
+	c.members[name] = services
+	for _, service := range services {
+		nodes, ok := c.byNamespace[service.Namespace]
+		if !ok {
+			nodes = make(map[string]*Service)
+			c.byNamespace[service.Namespace] = nodes
+		}
+		nodes[name] = service
+
+		for pattern := range service.Topic {
+			subscribers, ok := c.byPattern[pattern]
+			if !ok {
+				subscribers = make(map[*Service]bool)
+				c.byPattern[pattern] = subscribers
+			}
+			subscribers[service] = true
+		}
+
+		changed[service.Namespace] = true
+	}
+
+	c.notifyLocked(changed)
+}
+
+func (c *serviceCache) remove(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.notifyLocked(c.removeLocked(name))
+}
+
+func (c *serviceCache) removeLocked(name string) map[string]bool {
+	changed := map[string]bool{}
+
+	for _, service := range c.members[name] {
+		if nodes, ok := c.byNamespace[service.Namespace]; ok {
+			delete(nodes, name)
+			if len(nodes) == 0 {
+				delete(c.byNamespace, service.Namespace)
+			}
+		}
+
+		for pattern := range service.Topic {
+			if subscribers, ok := c.byPattern[pattern]; ok {
+				delete(subscribers, service)
+				if len(subscribers) == 0 {
+					delete(c.byPattern, pattern)
+				}
+			}
+		}
+
+		changed[service.Namespace] = true
+	}
+
+	delete(c.members, name)
+
+	return changed
+}
+
+func (c *serviceCache) readAll() []*Service {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	services := []*Service{}
+	for _, servs := range c.members {
+		services = append(services, servs...)
+	}
+
+	sortServices(services)
+
+	return services
+}
+
+func (c *serviceCache) hasNamespace(namespace string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	_, ok := c.byNamespace[namespace]
+	return ok
+}
+
+func (c *serviceCache) hasPattern(pattern string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	_, ok := c.byPattern[pattern]
+	return ok
+}
+
+func (c *serviceCache) readNS(namespace string) []*Service {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.readNSLocked(namespace)
+}
+
+func (c *serviceCache) readNSLocked(namespace string) []*Service {
+	services := []*Service{}
+	for _, service := range c.byNamespace[namespace] {
+		if service.Status == ServiceAlive {
+			services = append(services, service)
+		}
+	}
+
+	sortServices(services)
+
+	return services
+}
+
+// readSubscriber walks the subscribed patterns, there are far fewer of them
+// than services.
+func (c *serviceCache) readSubscriber(topic string) map[string][]*Service {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	found := map[*Service]bool{}
+	for pattern, subscribers := range c.byPattern {
+		if !MatchTopic(pattern, topic) {
+			continue
+		}
+
+		for service := range subscribers {
+			if service.Status == ServiceAlive {
+				found[service] = true
+			}
+		}
+	}
+
+	ns := map[string][]*Service{}
+	for service := range found {
+		ns[service.Namespace] = append(ns[service.Namespace], service)
+	}
+
+	for _, services := range ns {
+		sortServices(services)
+	}
+
+	return ns
+}
+
+func (c *serviceCache) watch(namespace string) (<-chan []*Service, func()) {
+	w := &watcher{ch: make(chan []*Service, 1)}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	watchers, ok := c.watchers[namespace]
+	if !ok {
+		watchers = make(map[*watcher]bool)
+		c.watchers[namespace] = watchers
+	}
+	watchers[w] = true
+
+	w.ch <- c.readNSLocked(namespace)
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+
+			delete(c.watchers[namespace], w)
+			if len(c.watchers[namespace]) == 0 {
+				delete(c.watchers, namespace)
+			}
+
+			close(w.ch)
+		})
+	}
+
+	return w.ch, stop
+}
+
+func (c *serviceCache) notifyLocked(changed map[string]bool) {
+	for namespace := range changed {
+		watchers, ok := c.watchers[namespace]
+		if !ok {
+			continue
+		}
+
+		snapshot := c.readNSLocked(namespace)
+		for w := range watchers {
+			select {
+			case <-w.ch:
+			default:
+			}
+
+			w.ch <- snapshot
+		}
+	}
+}
+
+func sortServices(services []*Service) {
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+
+		return services[i].GetCommAddr().String() < services[j].GetCommAddr().String()
+	})
+}
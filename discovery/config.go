@@ -16,4 +16,11 @@ type Config struct {
 	Name    string
 	Addr    *net.TCPAddr
 	Network NetworkType
+	Weight  int
+
+	// base64 gossip encryption key, members without it cannot join.
+	EncryptKey string
+
+	// file keeping keys installed at runtime across restarts.
+	KeyringFile string
 }
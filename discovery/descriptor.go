@@ -0,0 +1,245 @@
+package discovery
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	DESCRIPTOR_FORMAT = 1
+
+	// Serf limits the encoded tags of a member to 512 bytes, a descriptor
+	// larger than this is gossiped apart and the tag only references it.
+	MAX_DESCRIPTOR_TAG_SIZE = 384
+
+	// Largest descriptor a node accepts from the cluster.
+	MAX_DESCRIPTOR_SIZE = 64 * 1024
+)
+
+/*
+
+	Descriptor is everything a node gossips about the services registered on
+	it. It is encoded as compressed JSON, small enough descriptors travel in
+	DESCRIPTOR_TAG and larger ones in the registry with only a reference in
+	DESCRIPTOR_REF_TAG.
+
+*/
+
+type Descriptor struct {
+	Format   int                  `json:"f"`
+	Revision uint64               `json:"r"`
+	CommPort uint16               `json:"p"`
+	Weight   int                  `json:"w,omitempty"`
+	Services []*ServiceDescriptor `json:"s,omitempty"`
+	Meta     map[string]string    `json:"m,omitempty"`
+}
+
+type ServiceDescriptor struct {
+	Namespace string `json:"n"`
+
+	// subscribed topic patterns with their filter, empty for no filter.
+	Topics map[string]string `json:"t,omitempty"`
+	Weight int               `json:"w,omitempty"`
+	Meta   map[string]string `json:"m,omitempty"`
+
+	// health of the service as its node checks it, alive is left out.
+	Status ServiceStatus `json:"st,omitempty"`
+}
+
+// CreateDescriptor describes the services of a node, services are kept in
+// namespace order so equal descriptors encode the same.
+func CreateDescriptor(revision uint64, commPort uint16, weight int, services []*Service) *Descriptor {
+	descriptor := &Descriptor{
+		Format:   DESCRIPTOR_FORMAT,
+		Revision: revision,
+		CommPort: commPort,
+		Weight:   weight,
+		Services: make([]*ServiceDescriptor, 0, len(services)),
+	}
+
+	for _, service := range services {
+		sd := &ServiceDescriptor{Namespace: service.Namespace, Status: service.Status}
+
+		if len(service.Topic) > 0 {
+			sd.Topics = make(map[string]string, len(service.Topic))
+			for topic := range service.Topic {
+				sd.Topics[topic] = service.Filters[topic]
+			}
+		}
+
+		if service.Weight != weight {
+			sd.Weight = service.Weight
+		}
+
+		descriptor.Services = append(descriptor.Services, sd)
+	}
+
+	sort.Slice(descriptor.Services, func(i, j int) bool {
+		return descriptor.Services[i].Namespace < descriptor.Services[j].Namespace
+	})
+
+	return descriptor
+}
+
+// ToServices reads the services of a member with the given status, a service
+// of an alive member keeps the status its node gossips.
+func (d *Descriptor) ToServices(ip net.IP, status ServiceStatus) []*Service {
+	services := make([]*Service, 0, len(d.Services))
+
+	for _, sd := range d.Services {
+		service := CreateService(sd.Namespace, ip, d.CommPort, status)
+		if status == ServiceAlive {
+			service.Status = sd.Status
+		}
+
+		service.Weight = d.Weight
+		if sd.Weight > 0 {
+			service.Weight = sd.Weight
+		}
+
+		for topic, filter := range sd.Topics {
+			service.SubscribeFilter(topic, filter)
+		}
+
+		services = append(services, service)
+	}
+
+	return services
+}
+
+func EncodeDescriptor(descriptor *Descriptor) ([]byte, error) {
+	raw, err := json.Marshal(descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	writer, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write(raw); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() > MAX_DESCRIPTOR_SIZE {
+		return nil, util.CreateMsgTooLongErr(MAX_DESCRIPTOR_SIZE, int64(buf.Len()))
+	}
+
+	return buf.Bytes(), nil
+}
+
+func DecodeDescriptor(encoded []byte) (*Descriptor, error) {
+	reader := flate.NewReader(bytes.NewReader(encoded))
+	defer reader.Close()
+
+	raw, err := ioutil.ReadAll(&limitReader{reader, MAX_DESCRIPTOR_SIZE * 16})
+	if err != nil {
+		return nil, err
+	}
+
+	var descriptor Descriptor
+	if err := json.Unmarshal(raw, &descriptor); err != nil {
+		return nil, err
+	}
+
+	if descriptor.Format != DESCRIPTOR_FORMAT {
+		return nil, util.CreateInvalidProtocol(fmt.Sprintf("unknown descriptor format %d", descriptor.Format))
+	}
+
+	return &descriptor, nil
+}
+
+// descriptorTag is the value of DESCRIPTOR_TAG, false when the descriptor
+// is too large to be a tag.
+func descriptorTag(encoded []byte) (string, bool) {
+	tag := strconv.Itoa(DESCRIPTOR_FORMAT) + ":" + base64.RawStdEncoding.EncodeToString(encoded)
+	return tag, len(tag) <= MAX_DESCRIPTOR_TAG_SIZE
+}
+
+func parseDescriptorTag(tag string) (*Descriptor, error) {
+	elems := strings.SplitN(tag, ":", 2)
+	if len(elems) != 2 || elems[0] != strconv.Itoa(DESCRIPTOR_FORMAT) {
+		return nil, util.CreateInvalidProtocol("invalid descriptor tag")
+	}
+
+	encoded, err := base64.RawStdEncoding.DecodeString(elems[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeDescriptor(encoded)
+}
+
+// DescriptorRef identifies a descriptor gossiped in the registry.
+type DescriptorRef struct {
+	Revision uint64
+	Checksum uint32
+}
+
+func createDescriptorRef(revision uint64, encoded []byte) DescriptorRef {
+	return DescriptorRef{Revision: revision, Checksum: crc32.ChecksumIEEE(encoded)}
+}
+
+func (r DescriptorRef) String() string {
+	return fmt.Sprintf("%d:%d:%08x", DESCRIPTOR_FORMAT, r.Revision, r.Checksum)
+}
+
+func parseDescriptorRef(tag string) (DescriptorRef, error) {
+	elems := strings.Split(tag, ":")
+	if len(elems) != 3 || elems[0] != strconv.Itoa(DESCRIPTOR_FORMAT) {
+		return DescriptorRef{}, util.CreateInvalidProtocol("invalid descriptor reference")
+	}
+
+	revision, err := strconv.ParseUint(elems[1], 10, 64)
+	if err != nil {
+		return DescriptorRef{}, err
+	}
+
+	checksum, err := strconv.ParseUint(elems[2], 16, 32)
+	if err != nil {
+		return DescriptorRef{}, err
+	}
+
+	return DescriptorRef{Revision: revision, Checksum: uint32(checksum)}, nil
+}
+
+// limitReader fails instead of truncating, a descriptor inflating past the
+// limit is rejected.
+type limitReader struct {
+	reader io.Reader
+	left   int
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		return 0, util.CreateInvalidProtocol("descriptor too large")
+	}
+
+	if len(p) > l.left {
+		p = p[:l.left]
+	}
+
+	n, err := l.reader.Read(p)
+	l.left -= n
+
+	return n, err
+}
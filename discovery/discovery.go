@@ -1,19 +1,33 @@
 package discovery
 
 type Discovery interface {
-	ReadLocalService() *Service
+	ReadLocalService(namespace string) *Service
+	ReadLocalServices() []*Service
 	ReadNS(namespace string) []*Service
 	ReadAll() []*Service
 	ReadMultiNS(namespaces []string) map[string][]*Service
 	ReadSubscriber(topic string) map[string][]*Service
 
+	Watch(namespace string) (<-chan []*Service, func())
+	CountMembers() map[string]int
+
+	// whether a member registered the namespace, or subscribed the exact
+	// topic pattern.
+	HasNamespace(namespace string) bool
+	HasSubscription(pattern string) bool
+
 	Register(ns string, commPort uint16) error
-	Unregister() error
+	Unregister(ns string) error
+	SetStatus(ns string, status ServiceStatus) error
+	Leave() error
 
-	Update(ns string, commPort uint16) error
+	SubscribeTopic(ns string, topicName string, filter string) error
+	UnsubscribeTopic(ns string, topicName string) error
 
-	SubscribeTopic(topicName string) error
-	UnsubscribeTopic(topicName string) error
+	ListKeys() (*KeyResponse, error)
+	InstallKey(key string) (*KeyResponse, error)
+	UseKey(key string) (*KeyResponse, error)
+	RemoveKey(key string) (*KeyResponse, error)
 
 	Start() (chan bool, error)
 	Stop() error
@@ -0,0 +1,169 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	// length of generated gossip keys, AES-256.
+	GOSSIP_KEY_SIZE = 32
+)
+
+// KeyResponse is the outcome of a keyring operation across the cluster.
+type KeyResponse struct {
+	// base64 key to the number of nodes that have it installed.
+	Keys     map[string]int
+	NumNodes int
+	NumResp  int
+	NumErr   int
+	Messages map[string]string
+}
+
+// GenerateKey returns a new base64 gossip encryption key.
+func GenerateKey() (string, error) {
+	key := make([]byte, GOSSIP_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func decodeKey(key string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, util.CreateInvalidArgs("encrypt", "key is not base64")
+	}
+
+	if err := memberlist.ValidateKey(raw); err != nil {
+		return nil, util.CreateInvalidArgs("encrypt", err.Error())
+	}
+
+	return raw, nil
+}
+
+/*
+
+	createKeyring reads the gossip keys of this node. Keys installed or
+	removed at runtime are written to the keyring file by Serf, once the file
+	exists its keys win over the configured key, the first one is primary.
+
+*/
+
+func createKeyring(encryptKey string, keyringFile string) (*memberlist.Keyring, error) {
+	keys := []string{}
+
+	if keyringFile != "" {
+		content, err := ioutil.ReadFile(keyringFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if len(content) > 0 {
+			if err := json.Unmarshal(content, &keys); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if encryptKey != "" {
+		found := false
+		for _, key := range keys {
+			found = found || key == encryptKey
+		}
+
+		if !found {
+			keys = append(keys, encryptKey)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	rawKeys := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		raw, err := decodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		rawKeys = append(rawKeys, raw)
+	}
+
+	return memberlist.NewKeyring(rawKeys, rawKeys[0])
+}
+
+func (s *SerfDiscovery) ListKeys() (*KeyResponse, error) {
+	return s.keyRequest(func(km *serf.KeyManager) (*serf.KeyResponse, error) {
+		return km.ListKeys()
+	})
+}
+
+// InstallKey adds a key on every node, it is used to decrypt until made
+// primary.
+func (s *SerfDiscovery) InstallKey(key string) (*KeyResponse, error) {
+	if _, err := decodeKey(key); err != nil {
+		return nil, err
+	}
+
+	return s.keyRequest(func(km *serf.KeyManager) (*serf.KeyResponse, error) {
+		return km.InstallKey(key)
+	})
+}
+
+// UseKey makes an installed key the one every node encrypts with.
+func (s *SerfDiscovery) UseKey(key string) (*KeyResponse, error) {
+	return s.keyRequest(func(km *serf.KeyManager) (*serf.KeyResponse, error) {
+		return km.UseKey(key)
+	})
+}
+
+// RemoveKey removes a key from every node, the primary key cannot be
+// removed.
+func (s *SerfDiscovery) RemoveKey(key string) (*KeyResponse, error) {
+	return s.keyRequest(func(km *serf.KeyManager) (*serf.KeyResponse, error) {
+		return km.RemoveKey(key)
+	})
+}
+
+// keyRequest runs a keyring operation on the cluster, nodes that failed it
+// are reported as an incomplete result along with the response.
+func (s *SerfDiscovery) keyRequest(request func(*serf.KeyManager) (*serf.KeyResponse, error)) (*KeyResponse, error) {
+	if !s.serf.EncryptionEnabled() {
+		return nil, util.CreateInvalidArgs("encrypt", "gossip encryption is not enabled")
+	}
+
+	resp, err := request(s.serf.KeyManager())
+	if resp == nil {
+		return nil, err
+	}
+
+	result := &KeyResponse{
+		Keys:     resp.Keys,
+		NumNodes: resp.NumNodes,
+		NumResp:  resp.NumResp,
+		NumErr:   resp.NumErr,
+		Messages: resp.Messages,
+	}
+
+	if err == nil || resp.NumErr == 0 {
+		return result, err
+	}
+
+	failures := make(map[string]error, len(resp.Messages))
+	for node, msg := range resp.Messages {
+		failures[node] = errors.New(msg)
+	}
+
+	return result, util.CreateIncompleteMultiErr(failures)
+}
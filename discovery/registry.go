@@ -0,0 +1,403 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	DESCRIPTOR_EVENT = "dmp-descriptor"
+	DESCRIPTOR_QUERY = "dmp-descriptor"
+
+	// A chunk carries the length of the node name, the node name, and the
+	// revision, checksum, index and count of the chunk ahead of its data.
+	DESCRIPTOR_CHUNK_HEADER_SIZE = 1 + 16
+
+	// a descriptor that takes more chunks is not broadcast, nodes pull it
+	// with a query once they see its reference.
+	DESCRIPTOR_MAX_CHUNKS = 8
+
+	DESCRIPTOR_QUERY_TIMEOUT = 5 * time.Second
+
+	// updates within this delay are broadcast once, with the last revision.
+	DESCRIPTOR_BROADCAST_DELAY = 500 * time.Millisecond
+)
+
+type registryEntry struct {
+	ref        DescriptorRef
+	descriptor *Descriptor
+}
+
+type assembly struct {
+	ref      DescriptorRef
+	chunks   [][]byte
+	received int
+}
+
+/*
+
+	registry is the gossiped key/value store of descriptors too large for a
+	tag, keyed by node name. A node broadcasts its descriptor in chunks over
+	Serf user events and answers queries for it, nodes that missed the events
+	pull it with a query when a member references a revision they lack. A
+	descriptor too large for a few chunks is only pulled. Only the descriptor
+	a member references in its tag is kept, whatever its revision, so a
+	stale or forged one cannot stick.
+
+*/
+
+type registry struct {
+	serf *serf.Serf
+
+	// name of this node, kept so the event loop never takes Serf locks.
+	localName string
+
+	// size limit of a user event, name and payload, Serf refuses larger.
+	eventLimit int
+
+	local      *registryEntry
+	localBytes []byte
+	broadcast  *time.Timer
+
+	entries    map[string]*registryEntry
+	assemblies map[string]*assembly
+	pulling    map[string]bool
+
+	// reference each member tags, only a descriptor matching it is kept.
+	wanted map[string]DescriptorRef
+
+	// nodes whose descriptor was stored since the event loop last took
+	// them, updateCh is signalled when one is added.
+	updated  map[string]bool
+	updateCh chan struct{}
+
+	lock   sync.Mutex
+	logger *slog.Logger
+}
+
+func createRegistry(logger *slog.Logger) *registry {
+	return &registry{
+		entries:    make(map[string]*registryEntry),
+		assemblies: make(map[string]*assembly),
+		pulling:    make(map[string]bool),
+		wanted:     make(map[string]DescriptorRef),
+		updated:    make(map[string]bool),
+		updateCh:   make(chan struct{}, 1),
+		logger:     logger,
+	}
+}
+
+// publish keeps the local descriptor to answer queries and broadcasts it
+// shortly after, so a burst of updates is broadcast once.
+func (r *registry) publish(ref DescriptorRef, descriptor *Descriptor, encoded []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.local = &registryEntry{ref: ref, descriptor: descriptor}
+	r.localBytes = encoded
+
+	if r.broadcast == nil {
+		r.broadcast = time.AfterFunc(DESCRIPTOR_BROADCAST_DELAY, r.broadcastLocal)
+	}
+}
+
+func (r *registry) broadcastLocal() {
+	r.lock.Lock()
+	r.broadcast = nil
+	local, encoded := r.local, r.localBytes
+	r.lock.Unlock()
+
+	if local == nil {
+		return
+	}
+
+	name := r.localName
+	size := r.eventLimit - len(DESCRIPTOR_EVENT) - DESCRIPTOR_CHUNK_HEADER_SIZE - len(name)
+	if size <= 0 {
+		return
+	}
+
+	count := (len(encoded) + size - 1) / size
+	if count > DESCRIPTOR_MAX_CHUNKS {
+		return
+	}
+
+	for index := 0; index < count; index++ {
+		end := (index + 1) * size
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+
+		chunk := encodeChunk(name, local.ref, index, count, encoded[index*size:end])
+		if err := r.serf.UserEvent(DESCRIPTOR_EVENT, chunk, false); err != nil {
+			r.logger.Warn("Error while broadcast descriptor", logging.ERROR_KEY, err)
+			return
+		}
+	}
+}
+
+// clear stops answering for the local descriptor once it fits a tag again.
+func (r *registry) clear() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.local = nil
+	r.localBytes = nil
+}
+
+// lookup returns the descriptor a member references. A descriptor not known
+// yet is pulled in the background, one the member no longer references is
+// dropped meanwhile.
+func (r *registry) lookup(name string, ref DescriptorRef) (*Descriptor, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.local != nil && name == r.localName {
+		return r.local.descriptor, true
+	}
+
+	r.wanted[name] = ref
+
+	if entry, ok := r.entries[name]; ok && entry.ref == ref {
+		return entry.descriptor, true
+	}
+
+	delete(r.entries, name)
+	r.pullLocked(name)
+
+	return nil, false
+}
+
+func (r *registry) forget(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.entries, name)
+	delete(r.assemblies, name)
+	delete(r.updated, name)
+	delete(r.wanted, name)
+}
+
+// takeUpdated returns the nodes whose descriptor was stored since the last
+// call, the event loop reads them again.
+func (r *registry) takeUpdated() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make([]string, 0, len(r.updated))
+	for name := range r.updated {
+		names = append(names, name)
+	}
+
+	r.updated = make(map[string]bool)
+
+	return names
+}
+
+func (r *registry) handleEvent(event serf.UserEvent) {
+	if event.Name != DESCRIPTOR_EVENT {
+		return
+	}
+
+	name, ref, index, count, data, err := decodeChunk(event.Payload)
+	if err != nil {
+		r.logger.Warn("Invalid descriptor chunk", logging.ERROR_KEY, err)
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if name == r.localName {
+		return
+	}
+
+	if wanted, ok := r.wanted[name]; !ok || wanted != ref {
+		return
+	}
+
+	if entry, ok := r.entries[name]; ok && entry.ref == ref {
+		return
+	}
+
+	asm, ok := r.assemblies[name]
+	if !ok || asm.ref != ref || len(asm.chunks) != count {
+		asm = &assembly{ref: ref, chunks: make([][]byte, count)}
+		r.assemblies[name] = asm
+	}
+
+	if asm.chunks[index] == nil {
+		asm.chunks[index] = data
+		asm.received++
+	}
+
+	if asm.received < count {
+		return
+	}
+
+	delete(r.assemblies, name)
+	r.storeLocked(name, ref, bytes.Join(asm.chunks, nil))
+}
+
+func (r *registry) handleQuery(query *serf.Query) {
+	if query.Name != DESCRIPTOR_QUERY {
+		return
+	}
+
+	r.lock.Lock()
+	local, encoded := r.local, r.localBytes
+	r.lock.Unlock()
+
+	if local == nil || string(query.Payload) != r.localName {
+		return
+	}
+
+	if err := query.Respond(encodeResponse(local.ref, encoded)); err != nil {
+		r.logger.Warn("Error while answer descriptor query", logging.ERROR_KEY, err)
+	}
+}
+
+func (r *registry) pullLocked(name string) {
+	if r.serf == nil || r.pulling[name] {
+		return
+	}
+
+	r.pulling[name] = true
+
+	go func() {
+		defer func() {
+			r.lock.Lock()
+			delete(r.pulling, name)
+			r.lock.Unlock()
+		}()
+
+		ref, encoded, err := r.pull(name)
+		if err != nil {
+			r.logger.Warn("Error while pull descriptor", "member", name, logging.ERROR_KEY, err)
+			return
+		}
+
+		r.lock.Lock()
+		r.storeLocked(name, ref, encoded)
+		r.lock.Unlock()
+	}()
+}
+
+// pull asks the node for its descriptor, the answer may be a newer
+// revision than the one that triggered the pull. It is kept only when it is
+// the one the member tags, a later lookup pulls again otherwise.
+func (r *registry) pull(name string) (DescriptorRef, []byte, error) {
+	resp, err := r.serf.Query(DESCRIPTOR_QUERY, []byte(name), &serf.QueryParam{
+		FilterNodes: []string{name},
+		Timeout:     DESCRIPTOR_QUERY_TIMEOUT,
+	})
+	if err != nil {
+		return DescriptorRef{}, nil, err
+	}
+
+	defer resp.Close()
+
+	for response := range resp.ResponseCh() {
+		if response.From == name {
+			return decodeResponse(response.Payload)
+		}
+	}
+
+	return DescriptorRef{}, nil, util.CreateTimeoutErr("Descriptor query to "+name, DESCRIPTOR_QUERY_TIMEOUT)
+}
+
+// storeLocked keeps a descriptor of the reference the member tags whose
+// checksum matches.
+func (r *registry) storeLocked(name string, ref DescriptorRef, encoded []byte) {
+	if wanted, ok := r.wanted[name]; !ok || wanted != ref {
+		return
+	}
+
+	if crc32.ChecksumIEEE(encoded) != ref.Checksum {
+		r.logger.Warn("Descriptor does not match its checksum", "member", name)
+		return
+	}
+
+	descriptor, err := DecodeDescriptor(encoded)
+	if err != nil {
+		r.logger.Warn("Invalid descriptor", "member", name, logging.ERROR_KEY, err)
+		return
+	}
+
+	r.entries[name] = &registryEntry{ref: ref, descriptor: descriptor}
+	r.updated[name] = true
+
+	select {
+	case r.updateCh <- struct{}{}:
+	default:
+	}
+}
+
+// revision, checksum, descriptor
+func encodeResponse(ref DescriptorRef, encoded []byte) []byte {
+	response := make([]byte, 12, 12+len(encoded))
+	binary.BigEndian.PutUint64(response[0:8], ref.Revision)
+	binary.BigEndian.PutUint32(response[8:12], ref.Checksum)
+
+	return append(response, encoded...)
+}
+
+func decodeResponse(response []byte) (DescriptorRef, []byte, error) {
+	if len(response) < 12 {
+		return DescriptorRef{}, nil, util.CreateInvalidProtocol("descriptor response too short")
+	}
+
+	ref := DescriptorRef{
+		Revision: binary.BigEndian.Uint64(response[0:8]),
+		Checksum: binary.BigEndian.Uint32(response[8:12]),
+	}
+
+	return ref, response[12:], nil
+}
+
+// name length, name, revision, checksum, chunk index, chunk count, data
+func encodeChunk(name string, ref DescriptorRef, index int, count int, data []byte) []byte {
+	chunk := make([]byte, 0, DESCRIPTOR_CHUNK_HEADER_SIZE+len(name)+len(data))
+	chunk = append(chunk, byte(len(name)))
+	chunk = append(chunk, name...)
+
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header[0:8], ref.Revision)
+	binary.BigEndian.PutUint32(header[8:12], ref.Checksum)
+	binary.BigEndian.PutUint16(header[12:14], uint16(index))
+	binary.BigEndian.PutUint16(header[14:16], uint16(count))
+
+	chunk = append(chunk, header...)
+	return append(chunk, data...)
+}
+
+func decodeChunk(chunk []byte) (string, DescriptorRef, int, int, []byte, error) {
+	if len(chunk) < 1 || len(chunk) < 1+int(chunk[0])+16 {
+		return "", DescriptorRef{}, 0, 0, nil, util.CreateInvalidProtocol("descriptor chunk too short")
+	}
+
+	nameLen := int(chunk[0])
+	name := string(chunk[1 : 1+nameLen])
+	header := chunk[1+nameLen : 1+nameLen+16]
+
+	ref := DescriptorRef{
+		Revision: binary.BigEndian.Uint64(header[0:8]),
+		Checksum: binary.BigEndian.Uint32(header[8:12]),
+	}
+	index := int(binary.BigEndian.Uint16(header[12:14]))
+	count := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if count == 0 || index >= count {
+		return "", DescriptorRef{}, 0, 0, nil, util.CreateInvalidProtocol("invalid descriptor chunk index")
+	}
+
+	return name, ref, index, count, chunk[1+nameLen+16:], nil
+}
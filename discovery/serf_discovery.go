@@ -3,20 +3,36 @@ package discovery
 import (
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/util"
 )
 
 const (
+	DESCRIPTOR_TAG     = "dmp"
+	DESCRIPTOR_REF_TAG = "dmp-ref"
+
+	// tags of older versions, still read from members not upgraded yet.
 	NAMESPACE_TAG = "namespace"
 	COMM_PORT_TAG = "messagePort"
 	TOPIC_TAG     = "topic"
+	WEIGHT_TAG    = "weight"
+
+	NAMESPACE_TAG_PREFIX = "NS:"
+	TOPIC_TAG_PREFIX     = "TAG:"
+	FILTER_TAG_PREFIX    = "FILTER:"
+
+	// separates the namespace from the topic in topic and filter tags.
+	NAMESPACE_SEPARATOR = ":"
 )
 
 type SerfDiscovery struct {
@@ -26,20 +42,38 @@ type SerfDiscovery struct {
 	serf        *serf.Serf
 	serfEventCh chan serf.Event
 
+	// Serf sends member events while it holds its member lock, so the
+	// event loop keeps the members it was sent and the local node name
+	// rather than asking Serf. Only the event loop uses members once it
+	// runs.
+	nodeName string
+	members  map[string]serf.Member
+
 	shutdownCh chan bool
 
-	logger *log.Logger
+	logger *slog.Logger
+
+	cache *serviceCache
+
+	local     map[string]*Service
+	commPort  uint16
+	revision  uint64
+	leaving   bool
+	localLock sync.Mutex
 
-	cache map[string][]*serf.Member
+	registry *registry
 }
 
-func CreateSerfDiscovery(conf *Config, syncPoint *SyncPoint, writer io.Writer) *SerfDiscovery {
+func CreateSerfDiscovery(conf *Config, syncPoint *SyncPoint, logger *slog.Logger) *SerfDiscovery {
 	discovery := &SerfDiscovery{
 		conf:        conf,
 		serfEventCh: make(chan serf.Event),
 		syncPoint:   syncPoint,
-		logger:      log.New(writer, "", log.LstdFlags),
-		cache:       make(map[string][]*serf.Member),
+		logger:      logger,
+		cache:       createServiceCache(),
+		local:       make(map[string]*Service),
+		members:     make(map[string]serf.Member),
+		registry:    createRegistry(logger),
 	}
 
 	return discovery
@@ -83,8 +117,14 @@ func (s *SyncPoint) GetCIDRAddresses(port uint16) ([]string, error) {
 func (s *SerfDiscovery) Start() (chan bool, error) {
 	done := make(chan bool)
 
-	serfConf := s.conf.serfConfig()
+	serfConf, err := s.conf.serfConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	serfConf.EventCh = s.serfEventCh
+	serfConf.LogOutput = logging.Writer(s.logger)
+	serfConf.MemberlistConfig.LogOutput = serfConf.LogOutput
 
 	serf, err := serf.Create(serfConf)
 	if err != nil {
@@ -92,6 +132,15 @@ func (s *SerfDiscovery) Start() (chan bool, error) {
 	}
 
 	s.serf = serf
+	s.nodeName = serf.LocalMember().Name
+	s.registry.serf = serf
+	s.registry.localName = s.nodeName
+	s.registry.eventLimit = serfConf.UserEventSizeLimit
+
+	for _, member := range serf.Members() {
+		s.members[member.Name] = member
+		s.refreshMember(&member)
+	}
 
 	go func() {
 		s.AutoJoin()
@@ -104,42 +153,42 @@ func (s *SerfDiscovery) Start() (chan bool, error) {
 }
 
 func (s *SerfDiscovery) Stop() error {
-	s.logger.Println("[DMP][Info] Get signal shutdown")
+	s.logger.Info("Shutting down discovery")
 
 	s.serf.Leave()
 	if err := s.serf.Shutdown(); err != nil {
-		s.logger.Println("[DMP][Error] cann't shutdown serf. force exits")
+		s.logger.Error("Cannot shutdown serf, force exits", logging.ERROR_KEY, err)
 		return err
 	}
 
 	return nil
 }
 
-func (s *SerfDiscovery) SetLogWriter(logWriter io.Writer) {
-	s.logger = log.New(logWriter, "", log.LstdFlags)
+func (s *SerfDiscovery) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.registry.logger = logger
 }
 
 func (s *SerfDiscovery) AutoJoin() {
-	s.logger.Printf("[DMP][Info]Start looking for contact point... \n")
+	s.logger.Info("Start looking for contact point")
 
 	nodeCount := s.contactPointJoin()
 	if nodeCount > 0 {
-		s.logger.Printf("[DMP][Info]Success Join with %d nodes \n", nodeCount)
+		s.logger.Info("Joined cluster", "nodes", nodeCount)
 		return
 	}
 
 	nodeCount = s.contactCIDRJoin()
 	if nodeCount > 0 {
-		s.logger.Printf("[DMP][Info]Success Join with %d nodes\n", nodeCount)
+		s.logger.Info("Joined cluster", "nodes", nodeCount)
 		return
 	}
 
-	s.logger.Println("[DMP][Info]No exists cluster found...")
-	s.logger.Println("[DMP][Info]Running alone in cluster...")
+	s.logger.Info("No existing cluster found, running alone in cluster")
 }
 
 func (s *SerfDiscovery) contactPointJoin() (nodeCount int) {
-	s.logger.Printf("[DMP][Info]ContactPoints %s lookup \n", s.syncPoint.Addresses)
+	s.logger.Info("Contact points lookup", "addresses", s.syncPoint.Addresses)
 
 	contactPoints := s.syncPoint.Addresses
 	if contactPoints != nil {
@@ -150,18 +199,19 @@ func (s *SerfDiscovery) contactPointJoin() (nodeCount int) {
 }
 
 func (s *SerfDiscovery) contactCIDRJoin() (nodeCount int) {
-	s.logger.Printf("[DMP][Info]ContactCIDR %s lookup \n", s.syncPoint.CIDR)
+	s.logger.Info("Contact CIDR lookup", "cidr", s.syncPoint.CIDR)
 
 	CIDR := s.syncPoint.CIDR
 	if CIDR != "" {
 		port := uint16(s.conf.Addr.Port)
 		contactPoints, err := s.syncPoint.GetCIDRAddresses(port)
-		fmt.Printf("[DMP][Debug]CIDR : %s", contactPoints)
 		if err != nil {
-			s.logger.Fatalf("[DMP][Error]Invalid CIDR : %s\n", err)
+			s.logger.Error("Invalid contact CIDR", "cidr", CIDR, logging.ERROR_KEY, err)
 			return nodeCount
 		}
 
+		s.logger.Debug("Contact CIDR addresses", "cidr", CIDR, "addresses", len(contactPoints))
+
 		nodeCount = s.Join(contactPoints)
 	}
 
@@ -181,174 +231,337 @@ func (s *SerfDiscovery) handleEvent() {
 	for {
 		select {
 		case event := <-s.serfEventCh:
-			if IsModifyMemberEvent(event) {
-				s.updateCache(event.(serf.MemberEvent))
+			switch e := event.(type) {
+			case serf.MemberEvent:
+				s.updateCache(e)
+			case serf.UserEvent:
+				s.registry.handleEvent(e)
+			case *serf.Query:
+				s.registry.handleQuery(e)
 			}
+		case <-s.registry.updateCh:
+			s.refreshUpdated()
 		case <-s.serf.ShutdownCh():
-			s.Unregister()
+			s.clearLocal()
 			return
 		}
 	}
 }
 
+// updateCache keeps the cache in line with the member list. A member that
+// left is dropped, a failed one stays with its services out of service.
 func (s *SerfDiscovery) updateCache(event serf.MemberEvent) {
-	if serf.EventMemberFailed == event.Type {
-		s.logger.Println("=========== Failed =============")
-		s.logger.Println(event.Members)
-	} else if serf.EventMemberLeave == event.Type {
-		s.logger.Println("===========  Leave =============")
-		s.logger.Println(event.Members)
+	for _, member := range event.Members {
+		switch event.Type {
+		case serf.EventMemberFailed:
+			s.logger.Warn("Member failed", "member", member.Name, "addr", member.Addr.String())
+		case serf.EventMemberLeave:
+			s.logger.Info("Member left", "member", member.Name, "addr", member.Addr.String())
+		}
+
+		switch event.Type {
+		case serf.EventMemberLeave, serf.EventMemberReap:
+			delete(s.members, member.Name)
+			s.registry.forget(member.Name)
+			s.cache.remove(member.Name)
+		case serf.EventMemberJoin, serf.EventMemberUpdate, serf.EventMemberFailed:
+			s.members[member.Name] = member
+			s.refreshMember(&member)
+		}
+	}
+}
+
+func (s *SerfDiscovery) refreshMember(member *serf.Member) {
+	services, err := s.memberServices(member)
+	if err != nil {
+		s.logger.Warn("Error while read member services", logging.ERROR_KEY, err)
+		return
+	}
+
+	s.cache.update(member.Name, services)
+}
+
+// refreshUpdated reads again the members whose descriptor the registry
+// got, from the member last sent with an event. A member that left
+// meanwhile stays out of the cache.
+func (s *SerfDiscovery) refreshUpdated() {
+	for _, name := range s.registry.takeUpdated() {
+		if member, ok := s.members[name]; ok {
+			s.refreshMember(&member)
+		}
 	}
 }
 
-func (s *SerfDiscovery) updateService(service *Service) error {
-	newTags := map[string]string{
-		NAMESPACE_TAG: service.Namespace,
-		COMM_PORT_TAG: strconv.Itoa(int(service.CommPort)),
+// updateTags gossips every service registered on this node. The node
+// descriptor is a tag while it fits, otherwise it goes to the registry and
+// the tag references it.
+func (s *SerfDiscovery) updateTags() error {
+	services := make([]*Service, 0, len(s.local))
+	for _, service := range s.local {
+		services = append(services, service)
+	}
+
+	s.revision = nextRevision(s.revision)
+	descriptor := CreateDescriptor(s.revision, s.commPort, s.conf.Weight, services)
+
+	encoded, err := EncodeDescriptor(descriptor)
+	if err != nil {
+		return err
+	}
+
+	tags := map[string]string{}
+
+	if tag, ok := descriptorTag(encoded); ok {
+		s.registry.clear()
+		tags[DESCRIPTOR_TAG] = tag
+	} else {
+		ref := createDescriptorRef(s.revision, encoded)
+		s.registry.publish(ref, descriptor, encoded)
+		tags[DESCRIPTOR_REF_TAG] = ref.String()
 	}
 
-	for topic, _ := range service.Topic {
-		newTags["TAG:"+topic] = topic
+	if err := s.serf.SetTags(tags); err != nil {
+		return err
 	}
 
-	return s.serf.SetTags(newTags)
+	local := s.serf.LocalMember()
+	s.refreshMember(&local)
+
+	return nil
 }
 
+// nextRevision returns a revision above last that is also above the
+// revisions of an earlier run of this node, peers keep those until the
+// node is reaped. It follows the wall clock in milliseconds.
+func nextRevision(last uint64) uint64 {
+	now := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if now > last {
+		return now
+	}
+
+	return last + 1
+}
+
+// Register adds a service to this node, registering a namespace again keeps
+// its subscriptions.
 func (s *SerfDiscovery) Register(ns string, commPort uint16) error {
-	member := s.serf.LocalMember()
+	if err := ValidateNamespace(ns); err != nil {
+		return err
+	}
 
-	service := &Service{
-		Namespace: ns,
-		IP:        member.Addr,
-		CommPort:  commPort,
+	s.localLock.Lock()
+	defer s.localLock.Unlock()
+
+	if _, ok := s.local[ns]; !ok {
+		status := ServiceAlive
+		if s.leaving {
+			status = ServiceLeaving
+		}
+
+		member := s.serf.LocalMember()
+		s.local[ns] = CreateService(ns, member.Addr, commPort, status)
 	}
 
-	return s.updateService(service)
+	s.commPort = commPort
+
+	return s.updateTags()
 }
 
-func (s *SerfDiscovery) Update(ns string, commPort uint16) error {
-	service := s.ReadLocalService()
-	service.Namespace = ns
-	service.CommPort = commPort
+func (s *SerfDiscovery) Unregister(ns string) error {
+	s.localLock.Lock()
+	defer s.localLock.Unlock()
+
+	if _, ok := s.local[ns]; !ok {
+		return util.CreateNotFoundErr("namespace", ns)
+	}
 
-	return s.updateService(service)
+	delete(s.local, ns)
+
+	return s.updateTags()
 }
 
-func (s *SerfDiscovery) Unregister() error {
-	return s.serf.SetTags(make(map[string]string))
+// SetStatus changes the status gossiped for a service of this node, only
+// alive services are read by other nodes. Once the node leaves its services
+// stay leaving.
+func (s *SerfDiscovery) SetStatus(ns string, status ServiceStatus) error {
+	s.localLock.Lock()
+	defer s.localLock.Unlock()
+
+	service, ok := s.local[ns]
+	if !ok {
+		return util.CreateNotFoundErr("namespace", ns)
+	}
+
+	if service.Status == status || s.leaving {
+		return nil
+	}
+
+	service.Status = status
+
+	return s.updateTags()
 }
 
-func (s *SerfDiscovery) ReadLocalService() *Service {
-	member := s.serf.LocalMember()
-	serv, err := ConvertMemberToService(&member)
-	if err != nil {
-		s.logger.Println("[DMP][Warning] Error : ", err.Error())
+// Leave gossips every service of this node as leaving so other nodes stop
+// routing to it, the node stays a member until Stop.
+func (s *SerfDiscovery) Leave() error {
+	s.localLock.Lock()
+	defer s.localLock.Unlock()
+
+	s.leaving = true
+	for _, service := range s.local {
+		service.Status = ServiceLeaving
 	}
 
-	return serv
+	if len(s.local) == 0 {
+		return nil
+	}
+
+	return s.updateTags()
 }
 
-func (s *SerfDiscovery) ReadAll() []*Service {
-	members := s.serf.Members()
-	services := make([]*Service, 0, len(members))
+// clearLocal forgets the services of this node once Serf shut down, there
+// is nobody left to gossip to.
+func (s *SerfDiscovery) clearLocal() {
+	s.localLock.Lock()
+	defer s.localLock.Unlock()
 
-	for _, member := range members {
-		_, found := member.Tags[NAMESPACE_TAG]
-		if found {
-			serv, err := ConvertMemberToService(&member)
-			if err != nil {
-				continue
-			}
-			s.logger.Println(serv)
+	s.local = make(map[string]*Service)
+	s.cache.remove(s.nodeName)
+}
 
-			services = append(services, serv)
+func (s *SerfDiscovery) ReadLocalService(ns string) *Service {
+	for _, service := range s.ReadLocalServices() {
+		if service.Namespace == ns {
+			return service
 		}
 	}
 
+	return nil
+}
+
+func (s *SerfDiscovery) ReadLocalServices() []*Service {
+	member := s.serf.LocalMember()
+	services, err := s.memberServices(&member)
+	if err != nil {
+		s.logger.Warn("Error while read member services", logging.ERROR_KEY, err)
+	}
+
 	return services
 }
 
-func (s *SerfDiscovery) ReadNS(namespace string) []*Service {
-	ns := s.readServiceAlive(func(member *serf.Member) bool {
-		ns, found := member.Tags[NAMESPACE_TAG]
-		return found && ns == namespace
-	})
+func (s *SerfDiscovery) ReadAll() []*Service {
+	return s.cache.readAll()
+}
 
-	return ns[namespace]
+func (s *SerfDiscovery) ReadNS(namespace string) []*Service {
+	return s.cache.readNS(namespace)
 }
 
 func (s *SerfDiscovery) ReadMultiNS(namespaces []string) map[string][]*Service {
-	return s.readServiceAlive(func(member *serf.Member) bool {
-		ns, found := member.Tags[NAMESPACE_TAG]
-		if found {
-			for _, expectNs := range namespaces {
-				if ns == expectNs {
-					return true
-				}
-			}
+	ns := make(map[string][]*Service, len(namespaces))
+
+	for _, namespace := range namespaces {
+		if services := s.cache.readNS(namespace); len(services) > 0 {
+			ns[namespace] = services
 		}
+	}
 
-		return false
-	})
+	return ns
 }
 
+// ReadSubscriber returns services with a subscription matching topic, either
+// the exact topic or a wildcard pattern.
 func (s *SerfDiscovery) ReadSubscriber(topic string) map[string][]*Service {
-	return s.readServiceAlive(func(member *serf.Member) bool {
-		fTag := "TAG:" + topic
-		_, ok := member.Tags[fTag]
-		return ok
-	})
+	return s.cache.readSubscriber(topic)
 }
 
-func (s *SerfDiscovery) readServiceAlive(f func(*serf.Member) bool) map[string][]*Service {
-	members := s.serf.Members()
-	ns := map[string][]*Service{}
+// Watch sends the alive services of namespace now and after every change,
+// until the returned stop function is called.
+func (s *SerfDiscovery) Watch(namespace string) (<-chan []*Service, func()) {
+	return s.cache.watch(namespace)
+}
 
-	for _, member := range members {
-		if serf.StatusAlive != member.Status {
-			continue
-		}
+func (s *SerfDiscovery) HasNamespace(namespace string) bool {
+	return s.cache.hasNamespace(namespace)
+}
 
-		if !f(&member) {
-			continue
-		}
+func (s *SerfDiscovery) HasSubscription(pattern string) bool {
+	return s.cache.hasPattern(pattern)
+}
 
-		serv, err := ConvertMemberToService(&member)
-		if err != nil {
-			s.logger.Println("[DMP][Warning] Error : ", err.Error())
-			continue
-		}
+// CountMembers counts the members Serf knows by their status, alive,
+// leaving, left or failed.
+func (s *SerfDiscovery) CountMembers() map[string]int {
+	counts := map[string]int{}
+	if s.serf == nil {
+		return counts
+	}
 
-		services, ok := ns[serv.Namespace]
-		if !ok {
-			services = []*Service{}
-			ns[serv.Namespace] = services
-		}
+	for _, member := range s.serf.Members() {
+		counts[member.Status.String()]++
+	}
 
-		services = append(services, serv)
-		ns[serv.Namespace] = services
+	return counts
+}
+
+// memberServices reads the services of a member from its descriptor tag,
+// from the registry when the tag references it, or from tags of an older
+// version.
+func (s *SerfDiscovery) memberServices(member *serf.Member) ([]*Service, error) {
+	tag, ok := member.Tags[DESCRIPTOR_REF_TAG]
+	if !ok {
+		s.registry.forget(member.Name)
+		return ConvertMemberToServices(member)
 	}
 
-	return ns
+	ref, err := parseDescriptorRef(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptor, ok := s.registry.lookup(member.Name, ref)
+	if !ok {
+		return []*Service{}, nil
+	}
+
+	return descriptor.ToServices(member.Addr, memberStatus(member)), nil
 }
 
-func (s *SerfDiscovery) SubscribeTopic(topic string) error {
-	lService := s.ReadLocalService()
-	lService.Subscribe(topic)
-	return s.updateService(lService)
+func (s *SerfDiscovery) SubscribeTopic(ns string, topic string, filter string) error {
+	if err := ValidateTopicPattern(topic); err != nil {
+		return err
+	}
+
+	s.localLock.Lock()
+	defer s.localLock.Unlock()
+
+	service, ok := s.local[ns]
+	if !ok {
+		return util.CreateNotFoundErr("namespace", ns)
+	}
+
+	service.SubscribeFilter(topic, filter)
+	return s.updateTags()
 }
 
-func (s *SerfDiscovery) UnsubscribeTopic(topic string) error {
-	lService := s.ReadLocalService()
-	lService.Unsubscribe(topic)
-	return s.updateService(lService)
+func (s *SerfDiscovery) UnsubscribeTopic(ns string, topic string) error {
+	s.localLock.Lock()
+	defer s.localLock.Unlock()
+
+	service, ok := s.local[ns]
+	if !ok {
+		return util.CreateNotFoundErr("namespace", ns)
+	}
+
+	service.Unsubscribe(topic)
+	return s.updateTags()
 }
 
 /*
 	Extend Config function to support serf
 */
 
-func (c *Config) serfConfig() *serf.Config {
+func (c *Config) serfConfig() (*serf.Config, error) {
 	serfConf := serf.DefaultConfig()
 
 	switch c.Network {
@@ -374,48 +587,149 @@ func (c *Config) serfConfig() *serf.Config {
 		serfConf.MemberlistConfig.AdvertisePort = port
 	}
 
-	return serfConf
+	// a node answers descriptor queries with its whole descriptor.
+	serfConf.QueryResponseSizeLimit = MAX_DESCRIPTOR_SIZE + 1024
+
+	keyring, err := createKeyring(c.EncryptKey, c.KeyringFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyring != nil {
+		serfConf.MemberlistConfig.Keyring = keyring
+		serfConf.KeyringFile = c.KeyringFile
+	}
+
+	return serfConf, nil
+}
+
+// ConvertMemberToServices reads the services of a member from its
+// descriptor tag. Members not upgraded yet carry tags of older versions,
+// either one NAMESPACE_TAG with "TAG:<topic>" keys or one "NS:<namespace>"
+// key per service with "TAG:<namespace>:<topic>" keys. A descriptor kept in
+// the registry is not read here.
+func ConvertMemberToServices(member *serf.Member) ([]*Service, error) {
+	if tag, ok := member.Tags[DESCRIPTOR_TAG]; ok {
+		descriptor, err := parseDescriptorTag(tag)
+		if err != nil {
+			return nil, err
+		}
+
+		return descriptor.ToServices(member.Addr, memberStatus(member)), nil
+	}
+
+	return convertLegacyTags(member)
 }
 
-func ConvertMemberToService(member *serf.Member) (*Service, error) {
+func convertLegacyTags(member *serf.Member) ([]*Service, error) {
+	services := map[string]*Service{}
+
+	_, legacy := member.Tags[NAMESPACE_TAG]
+	for key := range member.Tags {
+		if strings.HasPrefix(key, NAMESPACE_TAG_PREFIX) {
+			legacy = false
+			break
+		}
+	}
+
+	if legacy {
+		services[member.Tags[NAMESPACE_TAG]] = nil
+	}
+
+	for key, ns := range member.Tags {
+		if strings.HasPrefix(key, NAMESPACE_TAG_PREFIX) {
+			services[ns] = nil
+		}
+	}
+
+	if len(services) == 0 {
+		return []*Service{}, nil
+	}
+
 	commPort, err := strconv.ParseUint(member.Tags[COMM_PORT_TAG], 10, 16)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Cannot get CommPort from member name %s \n", member.Name))
 	}
 
-	var status ServiceStatus
-	switch member.Status {
-	case serf.StatusAlive:
-		status = ServiceAlive
-	default:
-		status = ServiceFail
+	status := memberStatus(member)
+
+	weight, weightErr := strconv.Atoi(member.Tags[WEIGHT_TAG])
+
+	for ns := range services {
+		service := CreateService(ns, member.Addr, uint16(commPort), status)
+		if weightErr == nil {
+			service.Weight = weight
+		}
+
+		services[ns] = service
 	}
 
-	service := CreateService(
-		member.Tags[NAMESPACE_TAG],
-		member.Addr,
-		uint16(commPort),
-		status,
-	)
+	for key, value := range member.Tags {
+		if strings.HasPrefix(key, TOPIC_TAG_PREFIX) {
+			if service, topic, ok := tagService(services, strings.TrimPrefix(key, TOPIC_TAG_PREFIX), legacy); ok {
+				service.Subscribe(topic)
+			}
+		}
 
-	for key, _ := range member.Tags {
-		found := strings.Index(key, "TAG:")
-		if found != -1 {
-			service.Subscribe(strings.Split(key, ":")[1])
+		if strings.HasPrefix(key, FILTER_TAG_PREFIX) {
+			if service, topic, ok := tagService(services, strings.TrimPrefix(key, FILTER_TAG_PREFIX), legacy); ok {
+				service.Filters[topic] = value
+			}
 		}
 	}
 
-	return service, nil
+	result := make([]*Service, 0, len(services))
+	for _, service := range services {
+		for topic := range service.Filters {
+			if !service.Topic[topic] {
+				delete(service.Filters, topic)
+			}
+		}
+
+		result = append(result, service)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Namespace < result[j].Namespace
+	})
+
+	return result, nil
+}
+
+// tagService splits the "<namespace>:<topic>" part of a topic tag.
+func tagService(services map[string]*Service, key string, legacy bool) (*Service, string, bool) {
+	if legacy {
+		for _, service := range services {
+			return service, key, true
+		}
+	}
+
+	elems := strings.SplitN(key, NAMESPACE_SEPARATOR, 2)
+	if len(elems) != 2 {
+		return nil, "", false
+	}
+
+	service, ok := services[elems[0]]
+	return service, elems[1], ok
+}
+
+func memberStatus(member *serf.Member) ServiceStatus {
+	switch member.Status {
+	case serf.StatusAlive:
+		return ServiceAlive
+	default:
+		return ServiceFail
+	}
 }
 
 func ConvertMembersToServices(members []*serf.Member) []*Service {
 	services := make([]*Service, 0, len(members))
 	for _, m := range members {
-		service, err := ConvertMemberToService(m)
+		servs, err := ConvertMemberToServices(m)
 		if err != nil {
 			continue
 		}
-		services = append(services, service)
+		services = append(services, servs...)
 	}
 
 	return services
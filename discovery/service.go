@@ -2,6 +2,9 @@ package discovery
 
 import (
 	"net"
+	"strings"
+
+	"github.com/soulski/dmp/util"
 )
 
 type ServiceStatus int
@@ -10,24 +13,34 @@ const (
 	ServiceAlive ServiceStatus = iota
 	ServiceFail
 	ServiceSuspect
+	// the node of the service is shutting down, it only finishes the work
+	// it already took.
+	ServiceLeaving
 )
 
 var serviceStatusName = map[ServiceStatus]string{
 	ServiceAlive:   "Alive",
 	ServiceFail:    "Out of service",
 	ServiceSuspect: "Suspect",
+	ServiceLeaving: "Leaving",
 }
 
 func (s ServiceStatus) String() string {
 	return serviceStatusName[s]
 }
 
+const (
+	DEFAULT_WEIGHT = 1
+)
+
 type Service struct {
 	Namespace string
 	IP        net.IP
 	CommPort  uint16
 	Topic     map[string]bool
+	Filters   map[string]string
 	Status    ServiceStatus
+	Weight    int
 }
 
 func CreateService(ns string, ip net.IP, commPort uint16, status ServiceStatus) *Service {
@@ -36,10 +49,22 @@ func CreateService(ns string, ip net.IP, commPort uint16, status ServiceStatus)
 		IP:        ip,
 		CommPort:  commPort,
 		Topic:     make(map[string]bool),
+		Filters:   make(map[string]string),
 		Status:    status,
+		Weight:    DEFAULT_WEIGHT,
 	}
 }
 
+// ValidateNamespace checks a namespace services register with, it is part
+// of the topic tags so it may not hold the separator.
+func ValidateNamespace(ns string) error {
+	if ns == "" || strings.Contains(ns, NAMESPACE_SEPARATOR) {
+		return util.CreateInvalidArgs("namespace", ns)
+	}
+
+	return nil
+}
+
 func (s *Service) GetCommAddr() *net.TCPAddr {
 	return &net.TCPAddr{
 		IP:   s.IP,
@@ -47,10 +72,45 @@ func (s *Service) GetCommAddr() *net.TCPAddr {
 	}
 }
 
+func (s *Service) GetWeight() int {
+	if s.Weight <= 0 {
+		return DEFAULT_WEIGHT
+	}
+
+	return s.Weight
+}
+
 func (s *Service) Subscribe(topic string) {
 	s.Topic[topic] = true
 }
 
+// SubscribeFilter subscribes topic, only messages matching the filter
+// expression are delivered unless the filter is empty.
+func (s *Service) SubscribeFilter(topic string, filter string) {
+	s.Subscribe(topic)
+
+	if filter != "" {
+		s.Filters[topic] = filter
+	} else {
+		delete(s.Filters, topic)
+	}
+}
+
 func (s *Service) Unsubscribe(topic string) {
 	delete(s.Topic, topic)
+	delete(s.Filters, topic)
+}
+
+// TopicFilters returns the filters of every subscription matching topic, an
+// empty filter takes every message.
+func (s *Service) TopicFilters(topic string) []string {
+	filters := []string{}
+
+	for pattern := range s.Topic {
+		if MatchTopic(pattern, topic) {
+			filters = append(filters, s.Filters[pattern])
+		}
+	}
+
+	return filters
 }
@@ -0,0 +1,86 @@
+package discovery
+
+import (
+	"strings"
+
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	TOPIC_SEPARATOR = "."
+
+	// SINGLE_LEVEL_WILDCARD matches exactly one level, "orders.*" matches
+	// "orders.created" but not "orders" or "orders.eu.created".
+	SINGLE_LEVEL_WILDCARD = "*"
+
+	// MULTI_LEVEL_WILDCARD matches zero or more levels, "billing.#" matches
+	// "billing", "billing.invoice" and "billing.invoice.paid".
+	MULTI_LEVEL_WILDCARD = "#"
+)
+
+// ValidateTopic checks a topic messages are published to, it may not hold
+// wildcards.
+func ValidateTopic(topic string) error {
+	for _, level := range strings.Split(topic, TOPIC_SEPARATOR) {
+		if level == "" || isWildcard(level) {
+			return util.CreateInvalidArgs("topic", topic)
+		}
+	}
+
+	return nil
+}
+
+// ValidateTopicPattern checks a topic subscribed to, wildcards have to take
+// a whole level.
+func ValidateTopicPattern(pattern string) error {
+	for _, level := range strings.Split(pattern, TOPIC_SEPARATOR) {
+		if level == "" {
+			return util.CreateInvalidArgs("topic", pattern)
+		}
+
+		if !isWildcard(level) && strings.ContainsAny(level, SINGLE_LEVEL_WILDCARD+MULTI_LEVEL_WILDCARD) {
+			return util.CreateInvalidArgs("topic", pattern)
+		}
+	}
+
+	return nil
+}
+
+func MatchTopic(pattern string, topic string) bool {
+	return matchLevels(
+		strings.Split(pattern, TOPIC_SEPARATOR),
+		strings.Split(topic, TOPIC_SEPARATOR),
+	)
+}
+
+func matchLevels(patterns []string, levels []string) bool {
+	for len(patterns) > 0 {
+		pattern := patterns[0]
+
+		if pattern == MULTI_LEVEL_WILDCARD {
+			for skip := 0; skip <= len(levels); skip++ {
+				if matchLevels(patterns[1:], levels[skip:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(levels) == 0 {
+			return false
+		}
+
+		if pattern != SINGLE_LEVEL_WILDCARD && pattern != levels[0] {
+			return false
+		}
+
+		patterns, levels = patterns[1:], levels[1:]
+	}
+
+	return len(levels) == 0
+}
+
+func isWildcard(level string) bool {
+	return level == SINGLE_LEVEL_WILDCARD || level == MULTI_LEVEL_WILDCARD
+}
@@ -1,38 +1,261 @@
 package dmp
 
 import (
+	"hash/fnv"
+	"math/rand"
 	"sync"
 
 	"github.com/soulski/dmp/discovery"
+	"github.com/soulski/dmp/util"
 )
 
+const (
+	ROUND_ROBIN       = "round-robin"
+	RANDOM            = "random"
+	LEAST_OUTSTANDING = "least-outstanding"
+	WEIGHTED          = "weighted"
+	CONSISTENT_HASH   = "hash"
+)
+
+type Balancer interface {
+	Select(services []*discovery.Service, routingKey string) *discovery.Service
+}
+
+var balancerFactory = map[string]func(load *loadTracker) Balancer{
+	ROUND_ROBIN: func(load *loadTracker) Balancer {
+		return &roundRobin{}
+	},
+	RANDOM: func(load *loadTracker) Balancer {
+		return &random{}
+	},
+	LEAST_OUTSTANDING: func(load *loadTracker) Balancer {
+		return &leastOutstanding{load: load}
+	},
+	WEIGHTED: func(load *loadTracker) Balancer {
+		return &weighted{}
+	},
+	CONSISTENT_HASH: func(load *loadTracker) Balancer {
+		return &consistentHash{fallback: &random{}}
+	},
+}
+
+func IsBalancer(name string) bool {
+	_, ok := balancerFactory[name]
+	return ok
+}
+
+/*
+
+	Balance keeps one Balancer per namespace, strategy chosen per namespace
+	falls back to the default strategy.
+
+*/
+
 type Balance struct {
-	Seeker    map[string]int
-	indexLock sync.Mutex
+	defaultStrategy string
+	strategies      map[string]string
+	balancers       map[string]Balancer
+	load            *loadTracker
+
+	lock sync.Mutex
 }
 
-func CreateBalance() *Balance {
-	return &Balance{
-		Seeker: make(map[string]int),
+func CreateBalance(defaultStrategy string, strategies map[string]string) (*Balance, error) {
+	if !IsBalancer(defaultStrategy) {
+		return nil, util.CreateInvalidArgs("balancer", defaultStrategy)
+	}
+
+	for _, strategy := range strategies {
+		if !IsBalancer(strategy) {
+			return nil, util.CreateInvalidArgs("balancer", strategy)
+		}
+	}
+
+	b := &Balance{
+		defaultStrategy: defaultStrategy,
+		strategies:      make(map[string]string),
+		balancers:       make(map[string]Balancer),
+		load:            createLoadTracker(),
 	}
+
+	for ns, strategy := range strategies {
+		b.strategies[ns] = strategy
+	}
+
+	return b, nil
 }
 
-func (b *Balance) Dispatch(namespace string, services []*discovery.Service) *discovery.Service {
-	b.indexLock.Lock()
+func (b *Balance) Dispatch(namespace string, services []*discovery.Service, routingKey string) *discovery.Service {
+	b.lock.Lock()
 
-	index, ok := b.Seeker[namespace]
+	balancer, ok := b.balancers[namespace]
 	if !ok {
-		index = 0
-		b.Seeker[namespace] = index
+		balancer = balancerFactory[b.strategyOf(namespace)](b.load)
+		b.balancers[namespace] = balancer
+	}
+
+	b.lock.Unlock()
+
+	return balancer.Select(services, routingKey)
+}
+
+func (b *Balance) Strategy(namespace string) string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.strategyOf(namespace)
+}
+
+func (b *Balance) SetStrategy(namespace string, strategy string) error {
+	if !IsBalancer(strategy) {
+		return util.CreateInvalidArgs("balancer", strategy)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.strategies[namespace] = strategy
+	delete(b.balancers, namespace)
+
+	return nil
+}
+
+func (b *Balance) strategyOf(namespace string) string {
+	if strategy, ok := b.strategies[namespace]; ok {
+		return strategy
+	}
+
+	return b.defaultStrategy
+}
+
+// Acquire counts a request in flight to service until Release is called.
+func (b *Balance) Acquire(service *discovery.Service) {
+	b.load.add(service, 1)
+}
+
+func (b *Balance) Release(service *discovery.Service) {
+	b.load.add(service, -1)
+}
+
+type loadTracker struct {
+	outstanding map[string]int
+	lock        sync.Mutex
+}
+
+func createLoadTracker() *loadTracker {
+	return &loadTracker{
+		outstanding: make(map[string]int),
+	}
+}
+
+func (l *loadTracker) add(service *discovery.Service, delta int) {
+	key := serviceKey(service)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.outstanding[key] += delta
+	if l.outstanding[key] <= 0 {
+		delete(l.outstanding, key)
+	}
+}
+
+func (l *loadTracker) get(service *discovery.Service) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.outstanding[serviceKey(service)]
+}
+
+/*
+
+	Strategies
+
+*/
+
+type roundRobin struct {
+	index int
+	lock  sync.Mutex
+}
+
+func (r *roundRobin) Select(services []*discovery.Service, routingKey string) *discovery.Service {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.index >= len(services) {
+		r.index = 0
+	}
+
+	service := services[r.index]
+	r.index++
+
+	return service
+}
+
+type random struct{}
+
+func (r *random) Select(services []*discovery.Service, routingKey string) *discovery.Service {
+	return services[rand.Intn(len(services))]
+}
+
+type leastOutstanding struct {
+	load *loadTracker
+}
+
+func (l *leastOutstanding) Select(services []*discovery.Service, routingKey string) *discovery.Service {
+	best := services[0]
+	bestLoad := l.load.get(best)
+
+	for _, service := range services[1:] {
+		if load := l.load.get(service); load < bestLoad {
+			best, bestLoad = service, load
+		}
 	}
 
-	if index >= len(services) {
-		index = 0
+	return best
+}
+
+type weighted struct{}
+
+func (w *weighted) Select(services []*discovery.Service, routingKey string) *discovery.Service {
+	total := 0
+	for _, service := range services {
+		total += service.GetWeight()
 	}
 
-	b.Seeker[namespace] = index + 1
+	pick := rand.Intn(total)
+	for _, service := range services {
+		if pick -= service.GetWeight(); pick < 0 {
+			return service
+		}
+	}
+
+	return services[len(services)-1]
+}
+
+// consistentHash uses rendezvous hashing so a routing key keeps landing on
+// the same member while it stays in the namespace.
+type consistentHash struct {
+	fallback Balancer
+}
 
-	b.indexLock.Unlock()
+func (c *consistentHash) Select(services []*discovery.Service, routingKey string) *discovery.Service {
+	if routingKey == "" {
+		return c.fallback.Select(services, routingKey)
+	}
+
+	var best *discovery.Service
+	var bestScore uint64
+
+	for _, service := range services {
+		h := fnv.New64a()
+		h.Write([]byte(routingKey))
+		h.Write([]byte(serviceKey(service)))
+
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = service, score
+		}
+	}
 
-	return services[index]
+	return best
 }
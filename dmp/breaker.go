@@ -0,0 +1,187 @@
+package dmp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/soulski/dmp/discovery"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+var breakerStateName = map[BreakerState]string{
+	BreakerClosed:   "Closed",
+	BreakerOpen:     "Open",
+	BreakerHalfOpen: "Half-open",
+}
+
+func (s BreakerState) String() string {
+	return breakerStateName[s]
+}
+
+// latency is smoothed with an exponentially weighted moving average.
+const LATENCY_SMOOTHING = 0.2
+
+type breaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	latency  time.Duration
+}
+
+type BreakerStatus struct {
+	State    BreakerState
+	Failures int
+	Latency  time.Duration
+}
+
+/*
+
+	Breakers eject a member from selection after Threshold consecutive
+	failed or slow calls. Once Cooldown has passed a single probe call is let
+	through, its result closes the breaker or opens it for another Cooldown.
+
+*/
+
+type Breakers struct {
+	threshold int
+	cooldown  time.Duration
+	slowCall  time.Duration
+
+	breakers map[string]*breaker
+	lock     sync.Mutex
+}
+
+func CreateBreakers(threshold int, cooldown time.Duration, slowCall time.Duration) *Breakers {
+	return &Breakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		slowCall:  slowCall,
+		breakers:  make(map[string]*breaker),
+	}
+}
+
+func (b *Breakers) get(service *discovery.Service) *breaker {
+	key := serviceKey(service)
+
+	br, ok := b.breakers[key]
+	if !ok {
+		br = &breaker{state: BreakerClosed}
+		b.breakers[key] = br
+	}
+
+	return br
+}
+
+func (b *Breakers) enabled() bool {
+	return b.threshold > 0
+}
+
+// Available leaves out members whose breaker is open, or half-open with a
+// probe already in flight.
+func (b *Breakers) Available(services []*discovery.Service) []*discovery.Service {
+	if !b.enabled() {
+		return services
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	available := make([]*discovery.Service, 0, len(services))
+
+	for _, service := range services {
+		br := b.get(service)
+
+		switch br.state {
+		case BreakerClosed:
+			available = append(available, service)
+		case BreakerOpen:
+			if now.Sub(br.openedAt) >= b.cooldown {
+				available = append(available, service)
+			}
+		case BreakerHalfOpen:
+			if !br.probing {
+				available = append(available, service)
+			}
+		}
+	}
+
+	return available
+}
+
+// Begin marks the call as the probe when the member's cooldown is over.
+func (b *Breakers) Begin(service *discovery.Service) {
+	if !b.enabled() {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	br := b.get(service)
+	if br.state == BreakerOpen && time.Since(br.openedAt) >= b.cooldown {
+		br.state = BreakerHalfOpen
+	}
+
+	if br.state == BreakerHalfOpen {
+		br.probing = true
+	}
+}
+
+func (b *Breakers) Done(service *discovery.Service, err error, latency time.Duration) {
+	if !b.enabled() {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	br := b.get(service)
+	br.probing = false
+
+	if br.latency == 0 {
+		br.latency = latency
+	} else {
+		br.latency += time.Duration(LATENCY_SMOOTHING * float64(latency-br.latency))
+	}
+
+	failed := err != nil || (b.slowCall > 0 && latency > b.slowCall)
+	if !failed {
+		br.state = BreakerClosed
+		br.failures = 0
+		return
+	}
+
+	br.failures++
+
+	if br.state == BreakerHalfOpen || br.failures >= b.threshold {
+		br.state = BreakerOpen
+		br.openedAt = time.Now()
+	}
+}
+
+func (b *Breakers) Status(service *discovery.Service) *BreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	br := b.get(service)
+
+	state := br.state
+	if state == BreakerOpen && time.Since(br.openedAt) >= b.cooldown {
+		state = BreakerHalfOpen
+	}
+
+	return &BreakerStatus{
+		State:    state,
+		Failures: br.failures,
+		Latency:  br.latency,
+	}
+}
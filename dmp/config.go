@@ -1,31 +1,167 @@
 package dmp
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/soulski/dmp/api"
+	"github.com/soulski/dmp/comm"
 	"github.com/soulski/dmp/discovery"
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	DEFAULT_REQUEST_TIMEOUT = 30 * time.Second
+	DEFAULT_REQUEST_RETRIES = 2
+	DEFAULT_RETRY_BACKOFF   = 100 * time.Millisecond
+
+	DEFAULT_BREAKER_THRESHOLD = 5
+	DEFAULT_BREAKER_COOLDOWN  = 10 * time.Second
+
+	DEFAULT_REDELIVERY_BACKOFF = time.Second
+
+	DEFAULT_DEAD_LETTER_LIMIT = 1000
+
+	DEFAULT_CHECK_INTERVAL  = 10 * time.Second
+	DEFAULT_CHECK_TIMEOUT   = 5 * time.Second
+	DEFAULT_CHECK_THRESHOLD = 2
+
+	DEFAULT_SHUTDOWN_TIMEOUT  = 30 * time.Second
+	DEFAULT_LEAVE_PROPAGATION = 2 * time.Second
 )
 
 func DefaultConfig() *Config {
 	return &Config{
-		BindAddr:    "0.0.0.0",
-		BindPort:    7946,
-		NetworkType: "lan",
+		BindAddr:        "0.0.0.0",
+		BindPort:        7946,
+		NetworkType:     "lan",
+		MaxFrameSize:    comm.DEFAULT_MAX_BODY_SIZE,
+		MaxMessageSize:  comm.DEFAULT_MAX_MESSAGE_SIZE,
+		ChunkSize:       comm.DEFAULT_CHUNK_SIZE,
+		RequestTimeout:  DEFAULT_REQUEST_TIMEOUT,
+		RequestRetries:  DEFAULT_REQUEST_RETRIES,
+		RetryBackoff:    DEFAULT_RETRY_BACKOFF,
+		DefaultBalancer: ROUND_ROBIN,
+		Weight:          discovery.DEFAULT_WEIGHT,
+
+		BreakerThreshold: DEFAULT_BREAKER_THRESHOLD,
+		BreakerCooldown:  DEFAULT_BREAKER_COOLDOWN,
+
+		RedeliveryBackoff: DEFAULT_REDELIVERY_BACKOFF,
+
+		DeadLetterLimit: DEFAULT_DEAD_LETTER_LIMIT,
+
+		CheckInterval:  DEFAULT_CHECK_INTERVAL,
+		CheckTimeout:   DEFAULT_CHECK_TIMEOUT,
+		CheckThreshold: DEFAULT_CHECK_THRESHOLD,
+
+		LogFormat: logging.DEFAULT_FORMAT,
+		LogLevel:  logging.DEFAULT_LEVEL,
+
+		ShutdownTimeout:  DEFAULT_SHUTDOWN_TIMEOUT,
+		LeavePropagation: DEFAULT_LEAVE_PROPAGATION,
+
+		CommPort: DEFAULT_COMM_PORT,
+		APIPort:  DEFAULT_API_PORT,
 	}
 }
 
 type Config struct {
-	NodeName      string
-	BindAddr      string
-	BindPort      int
-	NetworkType   string
-	ContactPoints []string
-	ContactCIDR   string
-	Namespace     string
-	NetInterface  string
+	NodeName       string
+	BindAddr       string
+	BindPort       int
+	NetworkType    string
+	ContactPoints  []string
+	ContactCIDR    string
+	Namespace      string
+	NetInterface   string
+	MaxFrameSize   int64
+	MaxMessageSize int64
+	ChunkSize      int
+	RequestTimeout time.Duration
+	RequestRetries int
+	RetryBackoff   time.Duration
+
+	DefaultBalancer string
+	Balancers       map[string]string
+	Weight          int
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	BreakerSlowCall  time.Duration
+
+	QueueDir          string
+	RedeliveryBackoff time.Duration
+	MaxRedeliveries   int
+
+	// dead letters kept, the oldest is dropped past the limit.
+	DeadLetterLimit int
+
+	// gossip encryption, a node without the key cannot join.
+	EncryptKey  string
+	KeyringFile string
+
+	// mutual TLS of the comm bus, enabled when the files are set.
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSCAFile   string
+
+	// authentication and ACL of the HTTP API, open when not set.
+	APIAuthFile string
+
+	// policy on the messages services of this node take, open when not set.
+	RecvPolicyFile string
+
+	// TLS of the HTTP API, client certificates signed by the CA identify
+	// callers.
+	APITLSCertFile string
+	APITLSKeyFile  string
+	APITLSCAFile   string
+
+	// host:port of the OTLP/HTTP collector spans are exported to, spans are
+	// not recorded when not set.
+	OTLPEndpoint string
+
+	// defaults of service health checks that leave them out.
+	CheckInterval  time.Duration
+	CheckTimeout   time.Duration
+	CheckThreshold int
+
+	// commands services may name as their script check, by name. Only the
+	// node operator sets them.
+	CheckScripts map[string][]string
+
+	// json or logfmt, every subsystem logs at LogLevel unless LogLevels
+	// gives it its own.
+	LogFormat string
+	LogLevel  string
+	LogLevels map[string]string
+
+	// time a stopping node waits for the work it took to drain. Before it
+	// stops taking work it keeps serving for LeavePropagation, within
+	// ShutdownTimeout, so peers see it leave and stop sending to it.
+	ShutdownTimeout  time.Duration
+	LeavePropagation time.Duration
+
+	// listen address of the comm bus, BindAddr when CommBindAddr is not
+	// set. A taken port fails the start unless CommPortFallback is set.
+	CommBindAddr     string
+	CommPort         int
+	CommPortFallback bool
+
+	// listen address of the HTTP API, every interface when APIBindAddr is
+	// not set, and the Unix socket also served when APISocket is set.
+	APIBindAddr string
+	APIPort     int
+	APISocket   string
 }
 
 func (c *Config) Merge(optionConf *Config) {
@@ -51,6 +187,251 @@ func (c *Config) Merge(optionConf *Config) {
 	if c.NetInterface == "" {
 		c.NetInterface = optionConf.NetInterface
 	}
+	if c.MaxFrameSize == 0 {
+		c.MaxFrameSize = optionConf.MaxFrameSize
+	}
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = optionConf.MaxMessageSize
+	}
+	if c.ChunkSize == 0 {
+		c.ChunkSize = optionConf.ChunkSize
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = optionConf.RequestTimeout
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = optionConf.RetryBackoff
+	}
+	if c.DefaultBalancer == "" {
+		c.DefaultBalancer = optionConf.DefaultBalancer
+	}
+	if c.Balancers == nil && optionConf.Balancers != nil {
+		c.Balancers = make(map[string]string, len(optionConf.Balancers))
+		for ns, strategy := range optionConf.Balancers {
+			c.Balancers[ns] = strategy
+		}
+	}
+	if c.Weight == 0 {
+		c.Weight = optionConf.Weight
+	}
+	if c.BreakerCooldown == 0 {
+		c.BreakerCooldown = optionConf.BreakerCooldown
+	}
+	if c.QueueDir == "" {
+		c.QueueDir = optionConf.QueueDir
+	}
+	if c.RedeliveryBackoff == 0 {
+		c.RedeliveryBackoff = optionConf.RedeliveryBackoff
+	}
+	if c.DeadLetterLimit == 0 {
+		c.DeadLetterLimit = optionConf.DeadLetterLimit
+	}
+	if c.EncryptKey == "" {
+		c.EncryptKey = optionConf.EncryptKey
+	}
+	if c.KeyringFile == "" {
+		c.KeyringFile = optionConf.KeyringFile
+	}
+	if c.TLSCertFile == "" {
+		c.TLSCertFile = optionConf.TLSCertFile
+	}
+	if c.TLSKeyFile == "" {
+		c.TLSKeyFile = optionConf.TLSKeyFile
+	}
+	if c.TLSCAFile == "" {
+		c.TLSCAFile = optionConf.TLSCAFile
+	}
+	if c.APIAuthFile == "" {
+		c.APIAuthFile = optionConf.APIAuthFile
+	}
+	if c.RecvPolicyFile == "" {
+		c.RecvPolicyFile = optionConf.RecvPolicyFile
+	}
+	if c.APITLSCertFile == "" {
+		c.APITLSCertFile = optionConf.APITLSCertFile
+	}
+	if c.APITLSKeyFile == "" {
+		c.APITLSKeyFile = optionConf.APITLSKeyFile
+	}
+	if c.APITLSCAFile == "" {
+		c.APITLSCAFile = optionConf.APITLSCAFile
+	}
+	if c.OTLPEndpoint == "" {
+		c.OTLPEndpoint = optionConf.OTLPEndpoint
+	}
+	if c.CheckInterval == 0 {
+		c.CheckInterval = optionConf.CheckInterval
+	}
+	if c.CheckTimeout == 0 {
+		c.CheckTimeout = optionConf.CheckTimeout
+	}
+	if c.CheckThreshold == 0 {
+		c.CheckThreshold = optionConf.CheckThreshold
+	}
+	if c.CheckScripts == nil && optionConf.CheckScripts != nil {
+		c.CheckScripts = make(map[string][]string, len(optionConf.CheckScripts))
+		for name, args := range optionConf.CheckScripts {
+			c.CheckScripts[name] = append([]string{}, args...)
+		}
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = optionConf.LogFormat
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = optionConf.LogLevel
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = optionConf.ShutdownTimeout
+	}
+	if c.LeavePropagation == 0 {
+		c.LeavePropagation = optionConf.LeavePropagation
+	}
+	if c.CommBindAddr == "" {
+		c.CommBindAddr = optionConf.CommBindAddr
+	}
+	if c.CommPort == 0 {
+		c.CommPort = optionConf.CommPort
+	}
+	if !c.CommPortFallback {
+		c.CommPortFallback = optionConf.CommPortFallback
+	}
+	if c.APIBindAddr == "" {
+		c.APIBindAddr = optionConf.APIBindAddr
+	}
+	if c.APIPort == 0 {
+		c.APIPort = optionConf.APIPort
+	}
+	if c.APISocket == "" {
+		c.APISocket = optionConf.APISocket
+	}
+	if c.LogLevels == nil && optionConf.LogLevels != nil {
+		c.LogLevels = make(map[string]string, len(optionConf.LogLevels))
+		for subsystem, level := range optionConf.LogLevels {
+			c.LogLevels[subsystem] = level
+		}
+	}
+}
+
+// ParseCheckScripts reads "name=command args..." given on the command line,
+// the command and its arguments are split on spaces.
+func ParseCheckScripts(pairs []string) (map[string][]string, error) {
+	scripts := make(map[string][]string, len(pairs))
+
+	for _, pair := range pairs {
+		elems := strings.SplitN(pair, "=", 2)
+		if len(elems) != 2 || elems[0] == "" {
+			return nil, util.CreateInvalidArgs("check-script", pair)
+		}
+
+		args := strings.Fields(elems[1])
+		if len(args) == 0 {
+			return nil, util.CreateInvalidArgs("check-script", pair)
+		}
+
+		scripts[elems[0]] = args
+	}
+
+	return scripts, nil
+}
+
+// ParseBalancers reads "namespace=strategy" pairs given on the command line.
+func ParseBalancers(pairs []string) (map[string]string, error) {
+	balancers := make(map[string]string, len(pairs))
+
+	for _, pair := range pairs {
+		elems := strings.SplitN(pair, "=", 2)
+		if len(elems) != 2 || elems[0] == "" || !IsBalancer(elems[1]) {
+			return nil, util.CreateInvalidArgs("ns-balancer", pair)
+		}
+
+		balancers[elems[0]] = elems[1]
+	}
+
+	return balancers, nil
+}
+
+func (c *Config) CommConfig(logger *slog.Logger) (*comm.Config, error) {
+	commConf := &comm.Config{
+		MaxBodySize:    c.MaxFrameSize,
+		MaxMessageSize: c.MaxMessageSize,
+		ChunkSize:      c.ChunkSize,
+		PortFallback:   c.CommPortFallback,
+	}
+
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" || c.TLSCAFile != "" {
+		certs, err := comm.CreateCertReloader(
+			c.TLSCertFile, c.TLSKeyFile, c.TLSCAFile,
+			comm.DEFAULT_CERT_RELOAD_INTERVAL, logger,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		commConf.TLS = certs
+	}
+
+	commConf.Merge(comm.DefaultConfig())
+
+	return commConf, nil
+}
+
+// APIConfig returns the API config and the certificates to close on stop,
+// nil without TLS.
+func (c *Config) APIConfig(logger *slog.Logger) (*api.Config, *comm.CertReloader, error) {
+	apiConf := &api.Config{
+		Addr:        net.JoinHostPort(c.APIBindAddr, strconv.Itoa(c.APIPort)),
+		Socket:      c.APISocket,
+		MaxBodySize: c.MaxMessageSize,
+	}
+
+	if c.APIAuthFile != "" {
+		auth, err := api.LoadAuth(c.APIAuthFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		apiConf.Auth = auth
+	}
+
+	if c.APITLSCertFile == "" && c.APITLSKeyFile == "" && c.APITLSCAFile == "" {
+		return apiConf, nil, nil
+	}
+
+	certs, err := comm.CreateCertReloader(
+		c.APITLSCertFile, c.APITLSKeyFile, c.APITLSCAFile,
+		comm.DEFAULT_CERT_RELOAD_INTERVAL, logger,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	apiConf.TLS = certs.ServerConfigAuth(tls.VerifyClientCertIfGiven)
+
+	return apiConf, certs, nil
+}
+
+// Logging sets up the loggers of every subsystem, writing to w.
+func (c *Config) Logging(w io.Writer) (*logging.Logging, error) {
+	logs, err := logging.CreateLogging(w, c.LogFormat, c.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := logs.SetLevels(c.LogLevels); err != nil {
+		return nil, err
+	}
+
+	return logs, nil
+}
+
+// CommAddr is the address the comm bus listens on.
+func (c *Config) CommAddr() (*net.TCPAddr, error) {
+	host := c.CommBindAddr
+	if host == "" {
+		host = c.BindAddr
+	}
+
+	return net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(c.CommPort)))
 }
 
 func (c *Config) DiscoveryConfig() (*discovery.Config, error) {
@@ -73,6 +454,10 @@ func (c *Config) DiscoveryConfig() (*discovery.Config, error) {
 		Name:    c.NodeName,
 		Addr:    addr,
 		Network: network,
+		Weight:  c.Weight,
+
+		EncryptKey:  c.EncryptKey,
+		KeyringFile: c.KeyringFile,
 	}, nil
 }
 
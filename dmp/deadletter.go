@@ -0,0 +1,125 @@
+package dmp
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+
+	"github.com/soulski/dmp/api/req"
+	"github.com/soulski/dmp/api/res"
+	"github.com/soulski/dmp/comm"
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/queue"
+	"github.com/soulski/dmp/util"
+)
+
+const DEAD_LETTER = "dead letter"
+
+// deadLetter keeps a message that could not be delivered, ns is the
+// namespace it was meant for and topic is empty unless it was published.
+func (d *DMP) deadLetter(ctx context.Context, ns string, topic string, cause error, attempts int, body []byte) {
+	letter, err := d.deadLetters.Add(ns, topic, cause.Error(), attempts, body)
+	if err != nil {
+		d.logger.ErrorContext(ctx, "Error while keep dead letter", "namespace", ns, logging.ERROR_KEY, err)
+		return
+	}
+
+	d.logger.WarnContext(ctx, "Message moved to dead letter", "namespace", ns, "letter", letter.ID, logging.ERROR_KEY, cause)
+}
+
+// deadEntry moves a notification from the WAL whose redeliveries were
+// exhausted to the dead letters.
+func (d *DMP) deadEntry(entry *queue.Entry, cause error) error {
+	_, err := d.deadLetters.Add(entry.Meta[comm.META_NAMESPACE], entry.Meta[comm.META_TOPIC], cause.Error(), entry.Attempts, entry.Body)
+	return err
+}
+
+func (d *DMP) ListDeadLetters(ns string, topic string) *res.DeadLetters {
+	letters := d.deadLetters.List(ns, topic)
+
+	result := make([]*res.DeadLetter, len(letters))
+	for index, letter := range letters {
+		result[index] = convertDeadLetter(letter, false)
+	}
+
+	return &res.DeadLetters{DeadLetters: result}
+}
+
+func (d *DMP) GetDeadLetter(id uint64) (*res.DeadLetter, error) {
+	letter, ok := d.deadLetters.Get(id)
+	if !ok {
+		return nil, util.CreateNotFoundErr(DEAD_LETTER, strconv.FormatUint(id, 10))
+	}
+
+	return convertDeadLetter(letter, true), nil
+}
+
+// ReplayDeadLetter delivers the letter again, to the service of its
+// namespace registered on this node or else to a member of the namespace.
+// The letter is removed once delivered.
+func (d *DMP) ReplayDeadLetter(id uint64) (*res.DeadLetter, error) {
+	letter, ok := d.deadLetters.Get(id)
+	if !ok {
+		return nil, util.CreateNotFoundErr(DEAD_LETTER, strconv.FormatUint(id, 10))
+	}
+
+	if err := d.replay(letter); err != nil {
+		if _, failErr := d.deadLetters.Failed(id, err.Error()); failErr != nil {
+			d.logger.Error("Error while update dead letter", "letter", id, logging.ERROR_KEY, failErr)
+		}
+
+		return nil, err
+	}
+
+	if _, err := d.deadLetters.Remove(id); err != nil {
+		return nil, err
+	}
+
+	return convertDeadLetter(letter, false), nil
+}
+
+// replay is the delivery of a letter, its failure updates the letter rather
+// than dead-letter the message again.
+func (d *DMP) replay(letter *queue.DeadLetter) error {
+	ns, contactPoint, err := d.route(letter.Namespace)
+	if err != nil {
+		_, err = d.notificate(letter.Namespace, letter.Body, &req.Options{})
+		if attempt, ok := err.(*attemptErr); ok {
+			return attempt.err
+		}
+
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.conf.RequestTimeout)
+	defer cancel()
+
+	return postAsync(ctx, ns, contactPoint, bytes.NewReader(letter.Body))
+}
+
+func (d *DMP) DeleteDeadLetter(id uint64) (bool, error) {
+	return d.deadLetters.Remove(id)
+}
+
+func (d *DMP) PurgeDeadLetters(ns string, topic string) (int, error) {
+	return d.deadLetters.Purge(ns, topic)
+}
+
+func convertDeadLetter(letter *queue.DeadLetter, withBody bool) *res.DeadLetter {
+	result := &res.DeadLetter{
+		ID:          letter.ID,
+		Namespace:   letter.Namespace,
+		Topic:       letter.Topic,
+		Reason:      letter.Reason,
+		Attempts:    letter.Attempts,
+		FirstFailed: letter.FirstFailed,
+		LastFailed:  letter.LastFailed,
+		Size:        len(letter.Body),
+	}
+
+	if withBody {
+		result.Body = string(letter.Body)
+	}
+
+	return result
+}
@@ -0,0 +1,243 @@
+package dmp
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/soulski/dmp/comm"
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/metrics"
+	"github.com/soulski/dmp/queue"
+	"github.com/soulski/dmp/tracing"
+	"github.com/soulski/dmp/util"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	MAX_REDELIVERY_BACKOFF = time.Minute
+	DELIVERY_QUEUE_SIZE    = 1024
+	DELIVERY_WORKERS       = 4
+
+	// how often Drain looks whether the WAL is empty.
+	DRAIN_POLL_INTERVAL = 100 * time.Millisecond
+)
+
+type deliverFunc func(ctx context.Context, entry *queue.Entry) error
+
+// deadFunc takes a message whose deliveries were exhausted, it is dropped
+// from the WAL only once deadFunc succeeded.
+type deadFunc func(entry *queue.Entry, err error) error
+
+/*
+
+	Delivery hands async messages kept in the WAL to the service. A message
+	is acked in the WAL only after the contact point answered 2xx, failed
+	deliveries are retried with a growing backoff until they succeed, or
+	until maxAttempts when set, after which they are handed to dead.
+
+*/
+
+type Delivery struct {
+	wal     *queue.WAL
+	deliver deliverFunc
+
+	timeout     time.Duration
+	backoff     time.Duration
+	maxAttempts int
+	dead        deadFunc
+
+	queueCh    chan *queue.Entry
+	shutdownCh chan struct{}
+	retries    sync.WaitGroup
+	workers    sync.WaitGroup
+
+	logger *slog.Logger
+}
+
+func CreateDelivery(wal *queue.WAL, deliver deliverFunc, timeout time.Duration, backoff time.Duration, maxAttempts int, dead deadFunc, logger *slog.Logger) *Delivery {
+	return &Delivery{
+		wal:         wal,
+		deliver:     deliver,
+		timeout:     timeout,
+		backoff:     backoff,
+		maxAttempts: maxAttempts,
+		dead:        dead,
+		queueCh:     make(chan *queue.Entry, DELIVERY_QUEUE_SIZE),
+		shutdownCh:  make(chan struct{}),
+		logger:      logger,
+	}
+}
+
+// Start redelivers whatever was left pending by a previous run and starts
+// delivering newly persisted messages.
+func (d *Delivery) Start() {
+	for index := 0; index < DELIVERY_WORKERS; index++ {
+		d.workers.Add(1)
+		go d.loop()
+	}
+
+	pending := d.wal.Pending()
+	if len(pending) > 0 {
+		d.logger.Info("Redeliver pending notifications", "count", len(pending))
+	}
+
+	for _, entry := range pending {
+		d.schedule(entry, 0)
+	}
+}
+
+// Persist writes the message to the WAL, once it returns the message
+// survives a restart and can be acked to the sender.
+func (d *Delivery) Persist(meta map[string]string, body []byte) error {
+	entry, err := d.wal.Append(meta, body)
+	if err != nil {
+		return err
+	}
+
+	d.schedule(entry, 0)
+
+	return nil
+}
+
+func (d *Delivery) schedule(entry *queue.Entry, delay time.Duration) {
+	d.retries.Add(1)
+
+	go func() {
+		defer d.retries.Done()
+
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C:
+			case <-d.shutdownCh:
+				return
+			}
+		}
+
+		select {
+		case d.queueCh <- entry:
+		case <-d.shutdownCh:
+		}
+	}()
+}
+
+func (d *Delivery) loop() {
+	defer d.workers.Done()
+
+	for {
+		select {
+		case entry := <-d.queueCh:
+			d.attempt(entry)
+		case <-d.shutdownCh:
+			return
+		}
+	}
+}
+
+func (d *Delivery) attempt(entry *queue.Entry) {
+	entry.Attempts++
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	err := d.deliver(ctx, entry)
+	cancel()
+
+	if err == nil {
+		if err := d.wal.Ack(entry.ID); err != nil {
+			d.logger.Error("Error while ack notification in wal", "entry", entry.ID, logging.ERROR_KEY, err)
+		}
+		return
+	}
+
+	if d.maxAttempts > 0 && entry.Attempts >= d.maxAttempts {
+		if deadErr := d.dead(entry, err); deadErr == nil {
+			if err := d.wal.Ack(entry.ID); err != nil {
+				d.logger.Error("Error while ack notification in wal", "entry", entry.ID, logging.ERROR_KEY, err)
+			}
+			return
+		} else {
+			d.logger.Error("Error while dead-letter notification", "entry", entry.ID, logging.ERROR_KEY, deadErr)
+		}
+	}
+
+	backoff := d.backoff << uint(entry.Attempts-1)
+	if backoff <= 0 || backoff > MAX_REDELIVERY_BACKOFF {
+		backoff = MAX_REDELIVERY_BACKOFF
+	}
+
+	d.logger.Warn("Delivery of notification failed",
+		"entry", entry.ID, "namespace", entry.Meta[comm.META_NAMESPACE], "attempt", entry.Attempts, "retry_in", backoff, logging.ERROR_KEY, err)
+
+	d.schedule(entry, backoff)
+}
+
+// Drain waits until every message in the WAL was delivered or dead-lettered,
+// or ctx is done.
+func (d *Delivery) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(DRAIN_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for d.Pending() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Pending counts the messages not delivered yet.
+func (d *Delivery) Pending() int {
+	return len(d.wal.Pending())
+}
+
+// Stop leaves undelivered messages pending in the WAL for the next run.
+func (d *Delivery) Stop() error {
+	close(d.shutdownCh)
+
+	d.retries.Wait()
+	d.workers.Wait()
+
+	return d.wal.Close()
+}
+
+// postAsync forwards an async message to the service of ns, anything but
+// 2xx is a failed delivery.
+func postAsync(ctx context.Context, ns string, contactPoint string, body io.Reader) error {
+	status, _, err := forward(ctx, ns, contactPoint, body)
+	if err != nil {
+		return err
+	}
+
+	if !util.IsSuccessStatus(status) {
+		return util.CreateHTTPStatusErr(contactPoint, status)
+	}
+
+	return nil
+}
+
+// forward puts a message to the contact point of the service ns and
+// returns its response, traced and measured.
+func forward(ctx context.Context, ns string, contactPoint string, body io.Reader) (int, []byte, error) {
+	ctx, span := tracing.Start(ctx, "contact point", trace.SpanKindClient,
+		tracing.ATTR_NAMESPACE.String(ns),
+		tracing.ATTR_CONTACT_POINT.String(contactPoint),
+	)
+
+	start := time.Now()
+	status, res, err := util.HTTPPutStatus(ctx, contactPoint, body)
+	metrics.ObserveContactPoint(ns, status, time.Since(start))
+
+	if status != 0 {
+		span.SetAttributes(tracing.ATTR_HTTP_STATUS.Int(status))
+	}
+	tracing.End(span, err)
+
+	return status, res, err
+}
@@ -1,127 +1,420 @@
 package dmp
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
-	"net"
-	"runtime/debug"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/soulski/dmp/api"
+	"github.com/soulski/dmp/api/req"
 	"github.com/soulski/dmp/api/res"
 	"github.com/soulski/dmp/comm"
 	"github.com/soulski/dmp/discovery"
+	"github.com/soulski/dmp/filter"
+	"github.com/soulski/dmp/health"
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/metrics"
+	"github.com/soulski/dmp/queue"
+	"github.com/soulski/dmp/tracing"
 	"github.com/soulski/dmp/util"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	DEFAULT_COMM_PORT = 30000
+	DEFAULT_API_PORT  = api.DEFAULT_PORT
+
+	// time left to export the last spans on stop.
+	TRACE_FLUSH_TIMEOUT = 5 * time.Second
 )
 
 type DMP struct {
-	conf         *Config
-	service      *discovery.Service
-	contactPoint string
+	conf *Config
+
+	// name of this node, sent along every message.
+	nodeName string
+
+	// contact point of every service registered on this node by namespace.
+	contactPoints map[string]string
+	contactLock   sync.RWMutex
 
 	api       *api.ApiServer
+	apiCerts  *comm.CertReloader
 	discovery discovery.Discovery
 	comm      *comm.Bus
+	commConf  *comm.Config
+	pool      *comm.Pool
 	balance   *Balance
+	breakers  *Breakers
+	delivery  *Delivery
+
+	deadLetters *queue.DeadLetters
+	filters     *filter.Cache
+	recvPolicy  *RecvPolicy
+
+	// flushes and stops the span export, nil when spans are not exported.
+	stopTracing func(context.Context) error
 
-	logger *log.Logger
+	// health check of services registered on this node by namespace.
+	checks    map[string]*health.Monitor
+	checkLock sync.Mutex
+
+	logging *logging.Logging
+	logger  *slog.Logger
 }
 
+// CreateDMP loads what the node needs before it binds its listeners, what
+// was opened is closed again when a later step fails.
 func CreateDMP(conf *Config, logWriter io.Writer) (*DMP, error) {
-	logger := log.New(logWriter, "", log.LstdFlags)
+	logs, err := conf.Logging(logWriter)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logs.Logger(logging.DMP)
+	commLogger := logs.Logger(logging.COMM)
+	apiLogger := logs.Logger(logging.API)
+
+	dmp := &DMP{
+		contactPoints: make(map[string]string),
+		checks:        make(map[string]*health.Monitor),
+	}
+
+	balance, err := CreateBalance(conf.DefaultBalancer, conf.Balancers)
+	if err != nil {
+		return nil, err
+	}
+
+	commAddr, err := conf.CommAddr()
+	if err != nil {
+		return nil, err
+	}
 
-	dmp := &DMP{}
+	if conf.RecvPolicyFile != "" {
+		policy, err := LoadRecvPolicy(conf.RecvPolicyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		dmp.recvPolicy = policy
+	}
 
 	discConf, _ := conf.DiscoveryConfig()
 	syncPoint := discovery.CreateSyncPoint(conf.ContactPoints, conf.ContactCIDR)
 	discovery := discovery.CreateSerfDiscovery(
 		discConf,
 		syncPoint,
-		logWriter,
+		logs.Logger(logging.DISCOVERY),
 	)
 
-	commAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", conf.BindAddr, DEFAULT_COMM_PORT))
+	dmp.discovery = discovery
+	dmp.conf = conf
+	dmp.logging = logs
+	dmp.logger = logger
+	dmp.balance = balance
+	dmp.breakers = CreateBreakers(conf.BreakerThreshold, conf.BreakerCooldown, conf.BreakerSlowCall)
+	dmp.filters = filter.CreateCache()
+
+	dmp.nodeName = conf.NodeName
+	if dmp.nodeName == "" {
+		// Serf names the node after the host as well.
+		dmp.nodeName, _ = os.Hostname()
+	}
+
+	deadLetters, err := queue.OpenDeadLetters(conf.QueueDir, conf.DeadLetterLimit)
 	if err != nil {
 		return nil, err
 	}
 
-	apiServ := api.CreateApiServer(dmp, logger)
+	dmp.deadLetters = deadLetters
 
-	comm, err := comm.CreateBus(commAddr, dmp, logger)
+	if conf.QueueDir != "" {
+		wal, err := queue.OpenWAL(conf.QueueDir)
+		if err != nil {
+			dmp.release()
+			return nil, err
+		}
+
+		dmp.delivery = CreateDelivery(
+			wal, dmp.deliverEntry, conf.RequestTimeout, conf.RedeliveryBackoff,
+			conf.MaxRedeliveries, dmp.deadEntry, logger,
+		)
+	}
+
+	if conf.OTLPEndpoint != "" {
+		stopTracing, err := tracing.Setup(conf.OTLPEndpoint, dmp.nodeName)
+		if err != nil {
+			dmp.release()
+			return nil, err
+		}
+
+		dmp.stopTracing = stopTracing
+	}
+
+	apiConf, apiCerts, err := conf.APIConfig(apiLogger)
 	if err != nil {
+		dmp.release()
+		return nil, err
+	}
+
+	dmp.apiCerts = apiCerts
+
+	commConf, err := conf.CommConfig(commLogger)
+	if err != nil {
+		dmp.release()
+		return nil, err
+	}
+
+	dmp.commConf = commConf
+	dmp.pool = comm.CreatePool(commConf)
+
+	comm, err := comm.CreateBus(commAddr, dmp, commConf, commLogger)
+	if err != nil {
+		dmp.release()
 		return nil, err
 	}
 
-	dmp.discovery = discovery
 	dmp.comm = comm
+
+	apiServ := api.CreateApiServer(dmp, apiConf, apiLogger)
+	if err := apiServ.Listen(); err != nil {
+		dmp.release()
+		return nil, err
+	}
+
 	dmp.api = apiServ
-	dmp.conf = conf
-	dmp.logger = logger
-	dmp.balance = CreateBalance()
 
 	return dmp, nil
 }
 
+// release closes what CreateDMP opened so far, for a node that could not be
+// created.
+func (d *DMP) release() {
+	if d.comm != nil {
+		d.comm.Stop(context.Background())
+	}
+
+	if d.pool != nil {
+		d.pool.Close()
+	}
+
+	if d.commConf != nil && d.commConf.TLS != nil {
+		d.commConf.TLS.Close()
+	}
+
+	if d.apiCerts != nil {
+		d.apiCerts.Close()
+	}
+
+	if d.stopTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), TRACE_FLUSH_TIMEOUT)
+		d.stopTracing(ctx)
+		cancel()
+	}
+
+	if d.delivery != nil {
+		d.delivery.Stop()
+	}
+
+	d.deadLetters.Close()
+}
+
 func (d *DMP) Start() error {
 	logger := d.logger
 
 	dcDone, err := d.discovery.Start()
 	if err != nil {
-		logger.Printf("[DMP][ERROR] Error while start Discovery \n %s \n", err)
+		logger.Error("Error while start discovery", logging.ERROR_KEY, err)
 		return err
 	}
 
+	metrics.SetMemberSource(d.discovery.CountMembers)
+	metrics.SetLabelSource(d.discovery.HasNamespace, d.discovery.HasSubscription)
+
+	if d.delivery != nil {
+		d.delivery.Start()
+		logger.Info("Notification delivery running")
+	}
+
 	go d.comm.Start()
-	logger.Printf("[DMP][Info]Start Communication running...")
+	logger.Info("Communication running", "addr", d.comm.BusAddr().String())
 
 	go d.api.Start()
-	logger.Println("[DMP][Info]Public API running...")
+	logger.Info("Public API running")
 
 	if dcDone != nil {
 		<-dcDone
-		logger.Printf("[DMP][Info]Start Discover running...")
+		logger.Info("Discovery running")
 	}
 
-	logger.Printf("[DMP][Info]DMP is running")
+	logger.Info("DMP is running", "node", d.nodeName)
 
 	return nil
 }
 
+// Stop shuts the node down gracefully. Its services are gossiped leaving so
+// peers route elsewhere, the node keeps serving for LeavePropagation so the
+// gossip reaches them, then the API and comm bus take no new work and the
+// work already taken, queued notifications included, drains. All of it
+// takes at most ShutdownTimeout before the node leaves the cluster. The
+// first error is returned once everything is stopped.
 func (d *DMP) Stop() error {
-	dcErr := d.discovery.Stop()
-	if dcErr != nil {
-		d.logger.Fatalf("[DMP][Warning] Error while stop discovery, force close discovery...")
+	var errs []error
+
+	d.stopMonitors()
+
+	d.logger.Info("Shutting down", "timeout", d.conf.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.conf.ShutdownTimeout)
+	defer cancel()
+
+	if err := d.discovery.Leave(); err != nil {
+		d.logger.Error("Error while gossip leaving", logging.ERROR_KEY, err)
+		errs = append(errs, err)
+	} else {
+		d.awaitLeave(ctx)
 	}
 
-	apiErr := d.api.Stop()
+	var apiErr, commErr error
+	var stopped sync.WaitGroup
+	stopped.Add(2)
+
+	go func() {
+		defer stopped.Done()
+		apiErr = d.api.Stop(ctx)
+	}()
+
+	go func() {
+		defer stopped.Done()
+		commErr = d.comm.Stop(ctx)
+	}()
+
+	stopped.Wait()
+
 	if apiErr != nil {
-		d.logger.Fatalf("[DMP][Warning] Error while stop api, force close discovery...")
+		d.logger.Error("Error while drain api calls", logging.ERROR_KEY, apiErr)
+		errs = append(errs, apiErr)
+	}
+
+	if commErr != nil {
+		d.logger.Error("Error while drain comm requests", logging.ERROR_KEY, commErr)
+		errs = append(errs, commErr)
+	}
+
+	if d.delivery != nil {
+		if err := d.delivery.Drain(ctx); err != nil {
+			d.logger.Warn("Notifications left pending in the WAL", "count", d.delivery.Pending(), logging.ERROR_KEY, err)
+		}
+	}
+
+	if err := d.discovery.Stop(); err != nil {
+		d.logger.Error("Error while stop discovery", logging.ERROR_KEY, err)
+		errs = append(errs, err)
+	}
+
+	d.pool.Close()
+
+	if d.commConf.TLS != nil {
+		d.commConf.TLS.Close()
+	}
+
+	if d.apiCerts != nil {
+		d.apiCerts.Close()
+	}
+
+	if d.stopTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), TRACE_FLUSH_TIMEOUT)
+		if err := d.stopTracing(ctx); err != nil {
+			d.logger.Warn("Error while export last spans", logging.ERROR_KEY, err)
+		}
+		cancel()
+	}
+
+	if d.delivery != nil {
+		if err := d.delivery.Stop(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := d.deadLetters.Close(); err != nil {
+		errs = append(errs, err)
 	}
 
-	if dcErr != nil {
-		return dcErr
-	} else if apiErr != nil {
-		return apiErr
+	if len(errs) > 0 {
+		return errs[0]
 	}
 
-	d.comm.Stop()
+	d.logger.Info("DMP is stopped")
 
 	return nil
 }
 
+// awaitLeave keeps serving while peers learn this node is leaving, until
+// LeavePropagation passed or ctx is done.
+func (d *DMP) awaitLeave(ctx context.Context) {
+	timer := time.NewTimer(d.conf.LeavePropagation)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
 func (d *DMP) ListMembers(ns string) *res.Members {
-	services := d.discovery.ReadNS(ns)
+	return d.convertMembers(d.discovery.ReadNS(ns))
+}
 
+// WatchMembers sends the members of a namespace now and whenever they change,
+// until stop is called.
+func (d *DMP) WatchMembers(ns string) (<-chan *res.Members, func()) {
+	snapshots, stopWatch := d.discovery.Watch(ns)
+	members := make(chan *res.Members)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(members)
+
+		for services := range snapshots {
+			select {
+			case members <- d.convertMembers(services):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			stopWatch()
+		})
+	}
+
+	return members, stop
+}
+
+func (d *DMP) convertMembers(services []*discovery.Service) *res.Members {
 	members := make([]*res.Member, len(services))
 	for index, service := range services {
+		breaker := d.breakers.Status(service)
+
 		members[index] = &res.Member{
 			IP:        service.IP.String(),
 			Namespace: service.Namespace,
 			Status:    service.Status.String(),
+			Breaker: &res.Breaker{
+				State:     breaker.State.String(),
+				Failures:  breaker.Failures,
+				LatencyMs: breaker.Latency.Seconds() * 1000,
+			},
 		}
 	}
 
@@ -147,137 +440,536 @@ func (d *DMP) ListAllMembers() *res.Members {
 	}
 }
 
-func (d *DMP) ServiceRegister(ns string, contactPoint string) (*res.Member, error) {
+func (d *DMP) ServiceRegister(ns string, contactPoint string, check *req.Check) (*res.Member, error) {
+	var monitor *health.Monitor
+	if check != nil {
+		var err error
+		if monitor, err = d.createMonitor(ns, contactPoint, check); err != nil {
+			return nil, err
+		}
+	}
+
 	commAddr := d.comm.BusAddr()
 	commPort := commAddr.Port
 
 	if err := d.discovery.Register(ns, uint16(commPort)); err != nil {
-		d.logger.Printf("[DMP][Warning] Error occur while register service : \n%s\n", err.Error())
+		d.logger.Warn("Error while register service", "namespace", ns, logging.ERROR_KEY, err)
 		return nil, err
 	}
 
-	d.contactPoint = contactPoint
+	d.contactLock.Lock()
+	d.contactPoints[ns] = contactPoint
+	d.contactLock.Unlock()
 
-	ls := d.discovery.ReadLocalService()
+	// registered again, the service is alive until its new check says not.
+	d.setMonitor(ns, monitor)
+	if err := d.discovery.SetStatus(ns, discovery.ServiceAlive); err != nil {
+		return nil, err
+	}
+
+	ls := d.discovery.ReadLocalService(ns)
+	if ls == nil {
+		return nil, util.CreateNotFoundErr("namespace", ns)
+	}
 
 	return &res.Member{
 		IP:        ls.IP.String(),
 		Namespace: ls.Namespace,
 		Status:    ls.Status.String(),
+		Check:     d.checkStatus(ns),
 	}, nil
 }
 
-func (d *DMP) ServiceUnregister() bool {
-	if err := d.discovery.Unregister(); err != nil {
-		d.logger.Printf("[DMP][Warning] Error occur while unregister service : \n%s\n", err.Error())
+func (d *DMP) ServiceUnregister(ns string) bool {
+	if err := d.discovery.Unregister(ns); err != nil {
+		d.logger.Warn("Error while unregister service", "namespace", ns, logging.ERROR_KEY, err)
 		return false
 	}
 
+	d.setMonitor(ns, nil)
+
+	d.contactLock.Lock()
+	delete(d.contactPoints, ns)
+	d.contactLock.Unlock()
+
 	return true
 }
 
-func (d *DMP) SubscribeTopic(topicName string) bool {
-	if err := d.discovery.SubscribeTopic(topicName); err != nil {
-		d.logger.Printf("[DMP][Warning] Error subscribe topic : \n%s\n", err.Error())
-		return false
+func (d *DMP) SubscribeTopic(ns string, topicName string, filterExpr string) (bool, error) {
+	if err := discovery.ValidateTopicPattern(topicName); err != nil {
+		return false, err
 	}
-	return true
+
+	if filterExpr != "" {
+		if _, err := d.filters.Get(filterExpr); err != nil {
+			return false, err
+		}
+	}
+
+	ns, _, err := d.route(ns)
+	if err != nil {
+		return false, err
+	}
+
+	if err := d.discovery.SubscribeTopic(ns, topicName, filterExpr); err != nil {
+		d.logger.Warn("Error while subscribe topic", "namespace", ns, "topic", topicName, logging.ERROR_KEY, err)
+		return false, nil
+	}
+	return true, nil
 }
 
-func (d *DMP) UnsubscribeTopic(topicName string) bool {
-	if err := d.discovery.UnsubscribeTopic(topicName); err != nil {
-		d.logger.Printf("[DMP][Warning] Error subscribe topic : \n%s\n", err.Error())
+func (d *DMP) UnsubscribeTopic(ns string, topicName string) bool {
+	ns, _, err := d.route(ns)
+	if err != nil {
+		d.logger.Warn("Error while unsubscribe topic", "namespace", ns, "topic", topicName, logging.ERROR_KEY, err)
+		return false
+	}
+
+	if err := d.discovery.UnsubscribeTopic(ns, topicName); err != nil {
+		d.logger.Warn("Error while unsubscribe topic", "namespace", ns, "topic", topicName, logging.ERROR_KEY, err)
 		return false
 	}
 	return true
 }
 
-func (d *DMP) Request(ns string, msg []byte) ([]byte, error) {
-	services := d.discovery.ReadNS(ns)
-	if len(services) <= 0 {
-		return nil, fmt.Errorf("Error : namespace %s is not found.", ns)
+func (d *DMP) GetBalancer(ns string) *res.Balancer {
+	return &res.Balancer{
+		Namespace: ns,
+		Strategy:  d.balance.Strategy(ns),
 	}
+}
 
-	service := d.balance.Dispatch(ns, services)
+func (d *DMP) SetBalancer(ns string, strategy string) (*res.Balancer, error) {
+	if err := d.balance.SetStrategy(ns, strategy); err != nil {
+		return nil, err
+	}
 
-	sender, err := comm.DialWithAddr(service.GetCommAddr())
-	defer sender.Close()
+	return d.GetBalancer(ns), nil
+}
+
+func (d *DMP) timeout(opts *req.Options) time.Duration {
+	if opts.Timeout > 0 {
+		return opts.Timeout
+	}
+
+	return d.conf.RequestTimeout
+}
 
+func (d *DMP) Request(ns string, msg []byte, opts *req.Options) (*res.Reply, error) {
+	start := time.Now()
+	reply, err := d.request(ns, msg, opts)
+	metrics.ObserveMessage(metrics.KIND_REQUEST, ns, "", err, time.Since(start))
+
+	return reply, err
+}
+
+func (d *DMP) request(ns string, msg []byte, opts *req.Options) (*res.Reply, error) {
+	if opts == nil {
+		opts = &req.Options{}
+	}
+
+	source, err := d.source(opts)
 	if err != nil {
-		debug.PrintStack()
 		return nil, err
 	}
 
-	if err := sender.Send(msg); err != nil {
-		debug.PrintStack()
+	reply := &res.Reply{}
+	deadline := time.Now().Add(d.timeout(opts))
+	tried := make(map[string]bool)
+	from := &origin{source: source}
+
+	for {
+		services, err := d.availableServices(ns, tried)
+		if err != nil {
+			return reply, err
+		}
+
+		service := d.balance.Dispatch(ns, services, opts.RoutingKey)
+		tried[serviceKey(service)] = true
+
+		body, attempt := d.requestOnce(callContext(opts), service, msg, from, deadline)
+		if attempt == nil {
+			reply.Body = body
+			return reply, nil
+		}
+
+		d.logger.WarnContext(opts.Context, "Request failed", "namespace", ns, "addr", service.GetCommAddr().String(), logging.ERROR_KEY, attempt)
+
+		if reply.Retries >= d.conf.RequestRetries {
+			return reply, attempt.err
+		}
+
+		if (attempt.sent && !opts.Idempotent) || util.IsForbidden(attempt.err) {
+			return reply, attempt.err
+		}
+
+		if remain, _ := d.availableServices(ns, tried); len(remain) == 0 {
+			return reply, attempt.err
+		}
+
+		if !waitRetry(d.conf.RetryBackoff, reply.Retries, deadline) {
+			return reply, attempt.err
+		}
+
+		reply.Retries++
+	}
+}
+
+func (d *DMP) requestOnce(ctx context.Context, service *discovery.Service, msg []byte, from *origin, deadline time.Time) ([]byte, *attemptErr) {
+	d.balance.Acquire(service)
+	defer d.balance.Release(service)
+
+	ctx, span := startSend(ctx, "comm request", service, from)
+
+	start := time.Now()
+	d.breakers.Begin(service)
+
+	res, err := d.sendRequest(ctx, service, msg, from, deadline)
+	if err != nil {
+		tracing.End(span, err.err)
+		d.breakers.Done(service, err.breakerErr(), time.Since(start))
 		return nil, err
 	}
 
+	tracing.End(span, nil)
+	d.breakers.Done(service, nil, time.Since(start))
+
+	return res, nil
+}
+
+func (d *DMP) sendRequest(ctx context.Context, service *discovery.Service, msg []byte, from *origin, deadline time.Time) ([]byte, *attemptErr) {
+	sender, err := d.pool.Dial(service.GetCommAddr(), comm.SYNC)
+	if err != nil {
+		return nil, &attemptErr{err: err, sent: false}
+	}
+
+	defer sender.Close()
+	sender.SetDeadline(deadline)
+	sender.SetNamespace(service.Namespace)
+	sender.SetSource(d.nodeName, from.source)
+	sender.SetTopic(from.topic)
+	sender.SetTrace(ctx)
+
+	if err := sender.Send(msg); err != nil {
+		return nil, &attemptErr{err: err, sent: true}
+	}
+
 	res, err := sender.Recv()
 	if err != nil {
-		debug.PrintStack()
-		return nil, err
+		return nil, &attemptErr{err: err, sent: true}
 	}
 
 	return res, nil
 }
 
-func (d *DMP) Publish(topic string, msg []byte) ([]byte, error) {
-	addrs := []*net.TCPAddr{}
+func (d *DMP) Publish(topic string, msg []byte, opts *req.Options) (*res.Publish, error) {
+	if opts == nil {
+		opts = &req.Options{}
+	}
+
+	if err := discovery.ValidateTopic(topic); err != nil {
+		return nil, err
+	}
+
 	nss := d.discovery.ReadSubscriber(topic)
+	if len(nss) <= 0 {
+		return nil, fmt.Errorf("Error : topic %s have no subscribe.", topic)
+	}
+
+	source, err := d.source(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	nss = d.filterSubscribers(nss, topic, filter.CreateMessage(opts.Headers, msg))
+	from := &origin{source: source, topic: topic}
+
+	deadline := time.Now().Add(d.timeout(opts))
+	results := make(chan *res.NamespaceDelivery, len(nss))
 
 	for ns, services := range nss {
-		service := d.balance.Dispatch(ns, services)
-		addrs = append(addrs, service.GetCommAddr())
+		go func(ns string, services []*discovery.Service) {
+			start := time.Now()
+
+			var delivery *res.NamespaceDelivery
+			var err error
+			if opts.Broadcast {
+				delivery, err = d.broadcastNamespace(callContext(opts), ns, services, msg, from, deadline)
+			} else {
+				delivery, err = d.publishNamespace(callContext(opts), ns, services, msg, from, opts, deadline)
+			}
+
+			metrics.ObserveMessage(metrics.KIND_PUBLISH, ns, topic, err, time.Since(start))
+			results <- delivery
+		}(ns, services)
 	}
 
-	if len(addrs) <= 0 {
-		return nil, fmt.Errorf("Error : topic %s have no subscribe.", topic)
+	result := &res.Publish{
+		Topic:      topic,
+		Broadcast:  opts.Broadcast,
+		Delivered:  []string{},
+		Failed:     []string{},
+		Namespaces: make([]*res.NamespaceDelivery, 0, len(nss)),
 	}
 
-	sender, err := comm.MultiDialAddr(addrs)
-	defer sender.Close()
+	for index := 0; index < len(nss); index++ {
+		delivery := <-results
+		result.Namespaces = append(result.Namespaces, delivery)
+
+		if delivery.Delivered {
+			result.Delivered = append(result.Delivered, delivery.Namespace)
+		} else {
+			result.Failed = append(result.Failed, delivery.Namespace)
+		}
+	}
 
+	sortPublish(result)
+
+	return result, nil
+}
+
+func (d *DMP) Notificate(ns string, msg []byte, opts *req.Options) ([]byte, error) {
+	if opts == nil {
+		opts = &req.Options{}
+	}
+
+	start := time.Now()
+	res, err := d.notificate(ns, msg, opts)
+
+	// the sender owns the letter of a notification the member failed to
+	// take, the member's node keeps only what it acked.
+	if attempt, ok := err.(*attemptErr); ok {
+		if !util.IsForbidden(attempt.err) {
+			d.deadLetter(callContext(opts), ns, "", attempt.err, 1, msg)
+		}
+		err = attempt.err
+	}
+
+	metrics.ObserveMessage(metrics.KIND_NOTIFICATION, ns, "", err, time.Since(start))
+
+	return res, err
+}
+
+// notificate delivers the message to one member of the namespace, a failed
+// delivery is returned as its *attemptErr.
+func (d *DMP) notificate(ns string, msg []byte, opts *req.Options) ([]byte, error) {
+	source, err := d.source(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := d.availableServices(ns, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if sender.Send(msg) != nil {
+	service := d.balance.Dispatch(ns, services, opts.RoutingKey)
+
+	res, attempt := d.notifyOnce(callContext(opts), service, msg, &origin{source: source}, time.Now().Add(d.timeout(opts)))
+	if attempt != nil {
+		return nil, attempt
+	}
+
+	return res, nil
+}
+
+func (d *DMP) notifyOnce(ctx context.Context, service *discovery.Service, msg []byte, from *origin, deadline time.Time) ([]byte, *attemptErr) {
+	d.balance.Acquire(service)
+	defer d.balance.Release(service)
+
+	ctx, span := startSend(ctx, "comm notify", service, from)
+
+	start := time.Now()
+	d.breakers.Begin(service)
+
+	res, err := d.sendNotification(ctx, service, msg, from, deadline)
+	if err != nil {
+		tracing.End(span, err.err)
+		d.breakers.Done(service, err.breakerErr(), time.Since(start))
 		return nil, err
 	}
 
-	return []byte("send"), nil
+	tracing.End(span, nil)
+	d.breakers.Done(service, nil, time.Since(start))
+
+	return res, nil
+}
+
+func (d *DMP) sendNotification(ctx context.Context, service *discovery.Service, msg []byte, from *origin, deadline time.Time) ([]byte, *attemptErr) {
+	sender, err := d.pool.Dial(service.GetCommAddr(), comm.ASYNC)
+	if err != nil {
+		return nil, &attemptErr{err: err, sent: false}
+	}
+
+	defer sender.Close()
+	sender.SetDeadline(deadline)
+	sender.SetNamespace(service.Namespace)
+	sender.SetSource(d.nodeName, from.source)
+	sender.SetTopic(from.topic)
+	sender.SetTrace(ctx)
+
+	if err := sender.Send(msg); err != nil {
+		return nil, &attemptErr{err: err, sent: true}
+	}
+
+	res, err := sender.Recv()
+	if err != nil {
+		return nil, &attemptErr{err: err, sent: true}
+	}
+
+	return res, nil
+}
+
+// callContext is the context of the API call, it carries the trace of the
+// caller.
+func callContext(opts *req.Options) context.Context {
+	if opts.Context != nil {
+		return opts.Context
+	}
+
+	return context.Background()
 }
 
-func (d *DMP) Notificate(ns string, msg []byte) ([]byte, error) {
+// startSend begins the span of an attempt to send a message to a member.
+func startSend(ctx context.Context, name string, service *discovery.Service, from *origin) (context.Context, trace.Span) {
+	return tracing.Start(ctx, name, trace.SpanKindClient,
+		tracing.ATTR_NAMESPACE.String(service.Namespace),
+		tracing.ATTR_TOPIC.String(from.topic),
+		tracing.ATTR_PEER.String(service.GetCommAddr().String()),
+	)
+}
+
+// availableServices lists members of ns that were not tried yet and whose
+// circuit breaker lets calls through.
+func (d *DMP) availableServices(ns string, tried map[string]bool) ([]*discovery.Service, error) {
 	services := d.discovery.ReadNS(ns)
 	if len(services) <= 0 {
 		return nil, fmt.Errorf("Error : namespace %s is not found.", ns)
 	}
 
-	service := d.balance.Dispatch(ns, services)
+	services = d.breakers.Available(excludeServices(services, tried))
+	if len(services) <= 0 {
+		return nil, errNoAvailableMember(ns)
+	}
+
+	return services, nil
+}
+
+func errNoAvailableMember(ns string) error {
+	return fmt.Errorf("Error : no available member in namespace %s.", ns)
+}
+
+// route finds the contact point of a service registered on this node. A
+// message without namespace goes to the only registered service, as sent
+// by nodes that host a single service.
+func (d *DMP) route(ns string) (string, string, error) {
+	d.contactLock.RLock()
+	defer d.contactLock.RUnlock()
+
+	if ns == "" && len(d.contactPoints) == 1 {
+		for ns, contactPoint := range d.contactPoints {
+			return ns, contactPoint, nil
+		}
+	}
 
-	sender, err := comm.DialWithType(service.GetCommAddr(), comm.ASYNC)
+	contactPoint, ok := d.contactPoints[ns]
+	if !ok {
+		return ns, "", util.CreateNotFoundErr("namespace", ns)
+	}
+
+	return ns, contactPoint, nil
+}
+
+func (d *DMP) Recv(req *comm.Request) ([]byte, error) {
+	ctx, span := tracing.Start(req.Context(), "comm receive", trace.SpanKindServer,
+		tracing.ATTR_NAMESPACE.String(req.Namespace()),
+		tracing.ATTR_TOPIC.String(req.Topic()),
+		tracing.ATTR_PEER.String(req.RemoteAddr.String()),
+	)
+
+	res, err := d.recv(ctx, req)
+	tracing.End(span, err)
+
+	return res, err
+}
+
+func (d *DMP) recv(ctx context.Context, req *comm.Request) ([]byte, error) {
+	ns, contactPoint, err := d.route(req.Namespace())
 	if err != nil {
+		d.logger.ErrorContext(ctx, "Error while route message", logging.ERROR_KEY, err)
 		return nil, err
 	}
 
-	defer sender.Close()
-
-	if sender.Send(msg) != nil {
+	if err := d.authorize(ns, req); err != nil {
 		return nil, err
 	}
 
-	return sender.Recv()
-}
+	if req.IsAsync() {
+		return nil, d.recvAsync(ctx, req, ns, contactPoint)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.conf.RequestTimeout)
+		defer cancel()
+	}
 
-func (d *DMP) Recv(msg []byte) ([]byte, error) {
-	serviceRes, err := util.HTTPPut(d.contactPoint, msg)
+	// a failed request is returned to its sender, it is not dead-lettered.
+	_, serviceRes, err := forward(ctx, ns, contactPoint, req.Body)
 	if err != nil {
-		d.logger.Println("[DMP][Error] Error while connect with service")
-		d.logger.Println("[DMP][Error] Error : ", err.Error())
+		d.logger.ErrorContext(ctx, "Error while connect with service", "contact_point", contactPoint, logging.ERROR_KEY, err)
 		return nil, err
 	}
 
 	return serviceRes, err
 }
+
+// recvAsync returns once the notification is safe, the sender is acked
+// after that. With a WAL it is safe once persisted, otherwise only once the
+// service took it.
+func (d *DMP) recvAsync(ctx context.Context, req *comm.Request, ns string, contactPoint string) error {
+	if d.delivery != nil {
+		body, err := req.ReadBodyLimit(d.conf.MaxMessageSize)
+		if err != nil {
+			return err
+		}
+
+		// the node acks the notification once persisted so it owns its
+		// dead letter, the trace is kept along to continue it once delivered.
+		meta := map[string]string{comm.META_NAMESPACE: ns, comm.META_TOPIC: req.Topic()}
+		tracing.Inject(ctx, propagation.MapCarrier(meta))
+		if correlation := logging.CorrelationID(ctx); correlation != "" {
+			meta[comm.META_CORRELATION] = correlation
+		}
+
+		if err := d.delivery.Persist(meta, body); err != nil {
+			d.logger.ErrorContext(ctx, "Error while persist notification", logging.ERROR_KEY, err)
+			return err
+		}
+
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.conf.RequestTimeout)
+	defer cancel()
+
+	// the failure goes back to the sender, which dead-letters the message.
+	if err := postAsync(ctx, ns, contactPoint, req.Body); err != nil {
+		d.logger.ErrorContext(ctx, "Error while connect with service", "contact_point", contactPoint, logging.ERROR_KEY, err)
+		return err
+	}
+
+	return nil
+}
+
+func (d *DMP) deliverEntry(ctx context.Context, entry *queue.Entry) error {
+	ns, contactPoint, err := d.route(entry.Meta[comm.META_NAMESPACE])
+	if err != nil {
+		return err
+	}
+
+	ctx = tracing.Extract(ctx, propagation.MapCarrier(entry.Meta))
+	ctx = logging.WithCorrelation(ctx, entry.Meta[comm.META_CORRELATION])
+
+	return postAsync(ctx, ns, contactPoint, bytes.NewReader(entry.Body))
+}
@@ -0,0 +1,134 @@
+package dmp
+
+import (
+	"time"
+
+	"github.com/soulski/dmp/api/req"
+	"github.com/soulski/dmp/api/res"
+	"github.com/soulski/dmp/discovery"
+	"github.com/soulski/dmp/health"
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/util"
+)
+
+// createMonitor reads the health check of a service, a check without a
+// probe GETs the contact point and takes any answer below 500. A script
+// check runs the command the node config gives to the script name.
+func (d *DMP) createMonitor(ns string, contactPoint string, check *req.Check) (*health.Monitor, error) {
+	def := &health.Definition{HTTP: check.HTTP, TCP: check.TCP}
+
+	if check.Script != "" {
+		args, ok := d.conf.CheckScripts[check.Script]
+		if !ok {
+			return nil, util.CreateInvalidArgs("check script", check.Script)
+		}
+
+		def.Script = args
+	}
+
+	if def.HTTP == "" && def.TCP == "" && len(def.Script) == 0 {
+		def.ContactPoint = contactPoint
+	}
+
+	probe, err := health.CreateCheck(def)
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := readDuration("interval", check.Interval, d.conf.CheckInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := readDuration("timeout", check.Timeout, d.conf.CheckTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := check.Threshold
+	if threshold <= 0 {
+		threshold = d.conf.CheckThreshold
+	}
+
+	return health.CreateMonitor(probe, interval, timeout, threshold, func(healthy bool, err error) {
+		d.healthChanged(ns, healthy, err)
+	}), nil
+}
+
+func readDuration(name string, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, util.CreateInvalidArgs(name, value)
+	}
+
+	return d, nil
+}
+
+// healthChanged gossips the service suspect while its check fails, other
+// nodes stop routing to it.
+func (d *DMP) healthChanged(ns string, healthy bool, err error) {
+	status := discovery.ServiceAlive
+	if !healthy {
+		status = discovery.ServiceSuspect
+		d.logger.Warn("Service is unhealthy", "namespace", ns, logging.ERROR_KEY, err)
+	} else {
+		d.logger.Info("Service is healthy again", "namespace", ns)
+	}
+
+	if err := d.discovery.SetStatus(ns, status); err != nil && !util.IsNotFound(err) {
+		d.logger.Warn("Error while gossip service status", "namespace", ns, logging.ERROR_KEY, err)
+	}
+}
+
+// setMonitor replaces the health check of a service, nil removes it.
+func (d *DMP) setMonitor(ns string, monitor *health.Monitor) {
+	d.checkLock.Lock()
+	previous, ok := d.checks[ns]
+	if monitor != nil {
+		d.checks[ns] = monitor
+	} else {
+		delete(d.checks, ns)
+	}
+	d.checkLock.Unlock()
+
+	if ok {
+		previous.Stop()
+	}
+
+	if monitor != nil {
+		monitor.Start()
+	}
+}
+
+func (d *DMP) checkStatus(ns string) *res.Check {
+	d.checkLock.Lock()
+	monitor, ok := d.checks[ns]
+	d.checkLock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	healthy, err := monitor.Status()
+	check := &res.Check{Check: monitor.String(), Healthy: healthy}
+	if err != nil {
+		check.Output = err.Error()
+	}
+
+	return check
+}
+
+func (d *DMP) stopMonitors() {
+	d.checkLock.Lock()
+	checks := d.checks
+	d.checks = make(map[string]*health.Monitor)
+	d.checkLock.Unlock()
+
+	for _, monitor := range checks {
+		monitor.Stop()
+	}
+}
@@ -0,0 +1,36 @@
+package dmp
+
+import (
+	"github.com/soulski/dmp/api/res"
+	"github.com/soulski/dmp/discovery"
+)
+
+func (d *DMP) ListKeys() (*res.Keyring, error) {
+	return convertKeyring(d.discovery.ListKeys())
+}
+
+func (d *DMP) InstallKey(key string) (*res.Keyring, error) {
+	return convertKeyring(d.discovery.InstallKey(key))
+}
+
+func (d *DMP) UseKey(key string) (*res.Keyring, error) {
+	return convertKeyring(d.discovery.UseKey(key))
+}
+
+func (d *DMP) RemoveKey(key string) (*res.Keyring, error) {
+	return convertKeyring(d.discovery.RemoveKey(key))
+}
+
+func convertKeyring(resp *discovery.KeyResponse, err error) (*res.Keyring, error) {
+	if resp == nil {
+		return nil, err
+	}
+
+	return &res.Keyring{
+		Keys:      resp.Keys,
+		Nodes:     resp.NumNodes,
+		Responses: resp.NumResp,
+		Errors:    resp.NumErr,
+		Messages:  resp.Messages,
+	}, err
+}
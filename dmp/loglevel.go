@@ -0,0 +1,21 @@
+package dmp
+
+import (
+	"github.com/soulski/dmp/api/res"
+)
+
+func (d *DMP) LogLevels() *res.LogLevels {
+	return &res.LogLevels{Levels: d.logging.Levels()}
+}
+
+// SetLogLevel changes the level of a subsystem while the node runs, it is
+// back to the configured one on restart.
+func (d *DMP) SetLogLevel(subsystem string, level string) (*res.LogLevels, error) {
+	if err := d.logging.SetLevel(subsystem, level); err != nil {
+		return nil, err
+	}
+
+	d.logger.Info("Log level changed", "target", subsystem, "level", level)
+
+	return d.LogLevels(), nil
+}
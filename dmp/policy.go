@@ -0,0 +1,188 @@
+package dmp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+
+	"github.com/soulski/dmp/api/req"
+	"github.com/soulski/dmp/comm"
+	"github.com/soulski/dmp/discovery"
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	// allows, or denies, every source namespace, messages sent on behalf of
+	// no service included.
+	ANY_SOURCE = "*"
+)
+
+type ServicePolicy struct {
+	Allow []string `json:"allow"`
+}
+
+type TopicPolicy struct {
+	Deny []string `json:"deny"`
+}
+
+/*
+
+	RecvPolicy decides which messages the services registered on this node
+	take, it is evaluated before a message is handed to the service. It is
+	read from a JSON file
+
+		{
+			"services": {"<namespace>": {"allow": ["orders", "billing"]}},
+			"topics":   {"<topic pattern>": {"deny": ["*"]}}
+		}
+
+	A service listed under services only takes messages from the source
+	namespaces it allows, services not listed take messages from anyone.
+	A published message is refused when a pattern matching its topic
+	denies its source.
+
+	The source is named by the sending node, it is only believed when
+	discovery reports that namespace registered on a member at the address
+	the message came from. Messages with any other source are refused.
+
+*/
+
+type RecvPolicy struct {
+	Services map[string]*ServicePolicy `json:"services"`
+	Topics   map[string]*TopicPolicy   `json:"topics"`
+}
+
+func LoadRecvPolicy(file string) (*RecvPolicy, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy RecvPolicy
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return nil, err
+	}
+
+	for pattern := range policy.Topics {
+		if err := discovery.ValidateTopicPattern(pattern); err != nil {
+			return nil, util.CreateInvalidArgs("policy topic", err.Error())
+		}
+	}
+
+	return &policy, nil
+}
+
+// Authorize checks a message from source, sent by caller, to the service
+// ns. topic is empty unless the message was published.
+func (p *RecvPolicy) Authorize(caller string, source string, ns string, topic string) error {
+	if service, ok := p.Services[ns]; ok && !containsSource(service.Allow, source) {
+		return util.CreateForbiddenErr(callerName(caller, source), "send to", ns)
+	}
+
+	if topic == "" {
+		return nil
+	}
+
+	for pattern, rule := range p.Topics {
+		if discovery.MatchTopic(pattern, topic) && containsSource(rule.Deny, source) {
+			return util.CreateForbiddenErr(callerName(caller, source), "publish", topic)
+		}
+	}
+
+	return nil
+}
+
+func containsSource(sources []string, source string) bool {
+	for _, s := range sources {
+		if s == ANY_SOURCE || (source != "" && s == source) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func callerName(caller string, source string) string {
+	if source == "" {
+		return caller
+	}
+
+	return source + "@" + caller
+}
+
+// authorize checks a received message against the policy of this node. The
+// caller is the peer certificate subject when the bus runs TLS, otherwise
+// the name the sending node claims.
+func (d *DMP) authorize(ns string, req *comm.Request) error {
+	if d.recvPolicy == nil {
+		return nil
+	}
+
+	caller := req.Peer
+	if caller == "" {
+		caller = req.Sender()
+	}
+
+	var err error
+	if !d.verifySource(req) {
+		err = util.CreateForbiddenErr(callerName(caller, req.Source()), "send on behalf of", req.Source())
+	} else {
+		err = d.recvPolicy.Authorize(caller, req.Source(), ns, req.Topic())
+	}
+
+	if err != nil {
+		d.logger.WarnContext(req.Context(), "Refuse message", "caller", caller, "source", req.Source(), logging.ERROR_KEY, err)
+	}
+
+	return err
+}
+
+// verifySource tells whether the source the message claims is registered on
+// the member it was sent from. A message without source claims nothing.
+func (d *DMP) verifySource(req *comm.Request) bool {
+	source := req.Source()
+	if source == "" {
+		return true
+	}
+
+	addr, ok := req.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, service := range d.discovery.ReadAll() {
+		if service.Namespace == source && service.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+
+	// sent by this node to itself over the loopback.
+	if addr.IP.IsLoopback() {
+		d.contactLock.RLock()
+		_, local := d.contactPoints[source]
+		d.contactLock.RUnlock()
+
+		return local
+	}
+
+	return false
+}
+
+// source is the namespace messages are sent on behalf of, the one the
+// caller named. It is never implied, the API only lets callers allowed to
+// register a namespace name it.
+func (d *DMP) source(opts *req.Options) (string, error) {
+	if opts.Source == "" {
+		return "", nil
+	}
+
+	d.contactLock.RLock()
+	defer d.contactLock.RUnlock()
+
+	if _, ok := d.contactPoints[opts.Source]; !ok {
+		return "", util.CreateNotFoundErr("namespace", opts.Source)
+	}
+
+	return opts.Source, nil
+}
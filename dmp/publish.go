@@ -0,0 +1,177 @@
+package dmp
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/soulski/dmp/api/req"
+	"github.com/soulski/dmp/api/res"
+	"github.com/soulski/dmp/discovery"
+	"github.com/soulski/dmp/filter"
+	"github.com/soulski/dmp/logging"
+	"github.com/soulski/dmp/util"
+)
+
+// publishNamespace delivers the message to one member of a subscriber
+// namespace, members compete for it. A member that could not be reached is
+// replaced by another one like a request is retried.
+func (d *DMP) publishNamespace(ctx context.Context, ns string, services []*discovery.Service, msg []byte, from *origin, opts *req.Options, deadline time.Time) (*res.NamespaceDelivery, error) {
+	delivery := &res.NamespaceDelivery{
+		Namespace: ns,
+		Instances: []*res.InstanceDelivery{},
+	}
+
+	tried := make(map[string]bool)
+	retries := 0
+
+	var lastErr error
+
+	for {
+		available := d.breakers.Available(excludeServices(services, tried))
+		if len(available) <= 0 {
+			break
+		}
+
+		service := d.balance.Dispatch(ns, available, opts.RoutingKey)
+		addr := service.GetCommAddr().String()
+		tried[serviceKey(service)] = true
+
+		_, attempt := d.notifyOnce(ctx, service, msg, from, deadline)
+		if attempt == nil {
+			delivery.Delivered = true
+			delivery.Instances = append(delivery.Instances, &res.InstanceDelivery{Addr: addr, Delivered: true})
+
+			return delivery, nil
+		}
+
+		d.logger.WarnContext(ctx, "Publish failed", "namespace", ns, "topic", from.topic, "addr", addr, logging.ERROR_KEY, attempt)
+
+		lastErr = attempt.err
+		delivery.Instances = append(delivery.Instances, &res.InstanceDelivery{Addr: addr, Error: attempt.Error()})
+
+		// a refused message is not dead-lettered, replaying it is refused too.
+		if util.IsForbidden(attempt.err) {
+			return delivery, attempt.err
+		}
+
+		if retries >= d.conf.RequestRetries || (attempt.sent && !opts.Idempotent) {
+			break
+		}
+
+		if !waitRetry(d.conf.RetryBackoff, retries, deadline) {
+			break
+		}
+
+		retries++
+	}
+
+	if lastErr == nil {
+		lastErr = errNoAvailableMember(ns)
+	}
+
+	d.deadLetter(ctx, ns, from.topic, lastErr, len(delivery.Instances), msg)
+
+	return delivery, lastErr
+}
+
+// broadcastNamespace delivers the message to every member of a subscriber
+// namespace, the namespace is delivered once all of them took it. The error
+// is the failure of one of them.
+func (d *DMP) broadcastNamespace(ctx context.Context, ns string, services []*discovery.Service, msg []byte, from *origin, deadline time.Time) (*res.NamespaceDelivery, error) {
+	delivery := &res.NamespaceDelivery{
+		Namespace: ns,
+		Instances: make([]*res.InstanceDelivery, len(services)),
+	}
+
+	var wg sync.WaitGroup
+	failures := make([]error, len(services))
+
+	for index, service := range services {
+		wg.Add(1)
+
+		go func(index int, service *discovery.Service) {
+			defer wg.Done()
+
+			instance := &res.InstanceDelivery{Addr: service.GetCommAddr().String()}
+			delivery.Instances[index] = instance
+
+			if _, attempt := d.notifyOnce(ctx, service, msg, from, deadline); attempt != nil {
+				d.logger.WarnContext(ctx, "Broadcast failed", "namespace", ns, "topic", from.topic, "addr", instance.Addr, logging.ERROR_KEY, attempt)
+				if !util.IsForbidden(attempt.err) {
+					d.deadLetter(ctx, ns, from.topic, attempt.err, 1, msg)
+				}
+				instance.Error = attempt.Error()
+				failures[index] = attempt.err
+				return
+			}
+
+			instance.Delivered = true
+		}(index, service)
+	}
+
+	wg.Wait()
+
+	var failure error
+
+	delivery.Delivered = true
+	for index, instance := range delivery.Instances {
+		delivery.Delivered = delivery.Delivered && instance.Delivered
+		if failures[index] != nil {
+			failure = failures[index]
+		}
+	}
+
+	return delivery, failure
+}
+
+// filterSubscribers keeps members with a subscription filter matching msg,
+// namespaces left without members do not take part in the publish.
+func (d *DMP) filterSubscribers(nss map[string][]*discovery.Service, topic string, msg *filter.Message) map[string][]*discovery.Service {
+	result := make(map[string][]*discovery.Service, len(nss))
+
+	for ns, services := range nss {
+		matched := make([]*discovery.Service, 0, len(services))
+
+		for _, service := range services {
+			if d.acceptMessage(service, topic, msg) {
+				matched = append(matched, service)
+			}
+		}
+
+		if len(matched) > 0 {
+			result[ns] = matched
+		}
+	}
+
+	return result
+}
+
+func (d *DMP) acceptMessage(service *discovery.Service, topic string, msg *filter.Message) bool {
+	for _, expr := range service.TopicFilters(topic) {
+		if expr == "" {
+			return true
+		}
+
+		f, err := d.filters.Get(expr)
+		if err != nil {
+			d.logger.Warn("Ignore invalid filter", "namespace", service.Namespace, "topic", topic, "addr", service.GetCommAddr().String(), logging.ERROR_KEY, err)
+			continue
+		}
+
+		if f.Match(msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortPublish(result *res.Publish) {
+	sort.Strings(result.Delivered)
+	sort.Strings(result.Failed)
+	sort.Slice(result.Namespaces, func(i, j int) bool {
+		return result.Namespaces[i].Namespace < result.Namespaces[j].Namespace
+	})
+}
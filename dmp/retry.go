@@ -0,0 +1,80 @@
+package dmp
+
+import (
+	"time"
+
+	"github.com/soulski/dmp/discovery"
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	MAX_RETRY_BACKOFF = 5 * time.Second
+)
+
+// attemptErr tells whether the message may have reached the member before
+// the attempt failed, such attempts are only retried for idempotent requests.
+type attemptErr struct {
+	err  error
+	sent bool
+}
+
+func (e *attemptErr) Error() string {
+	return e.err.Error()
+}
+
+// breakerErr is the failure the circuit breaker counts, a member refusing
+// the message by policy is healthy.
+func (e *attemptErr) breakerErr() error {
+	if util.IsForbidden(e.err) {
+		return nil
+	}
+
+	return e.err
+}
+
+// origin tells the receiving node where a message comes from, topic is
+// empty unless it was published.
+type origin struct {
+	source string
+	topic  string
+}
+
+func retryBackoff(base time.Duration, retry int) time.Duration {
+	backoff := base << uint(retry)
+	if backoff <= 0 || backoff > MAX_RETRY_BACKOFF {
+		backoff = MAX_RETRY_BACKOFF
+	}
+
+	return backoff
+}
+
+// waitRetry sleeps before the next retry and reports false when the request
+// deadline would pass first.
+func waitRetry(base time.Duration, retry int, deadline time.Time) bool {
+	backoff := retryBackoff(base, retry)
+	if time.Now().Add(backoff).After(deadline) {
+		return false
+	}
+
+	time.Sleep(backoff)
+
+	return true
+}
+
+func excludeServices(services []*discovery.Service, tried map[string]bool) []*discovery.Service {
+	remain := make([]*discovery.Service, 0, len(services))
+
+	for _, service := range services {
+		if !tried[serviceKey(service)] {
+			remain = append(remain, service)
+		}
+	}
+
+	return remain
+}
+
+// serviceKey tells services apart, one node serves several namespaces on
+// the same comm address.
+func serviceKey(service *discovery.Service) string {
+	return service.Namespace + "@" + service.GetCommAddr().String()
+}
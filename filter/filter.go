@@ -0,0 +1,252 @@
+package filter
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	HEADER_FIELD = "header"
+	BODY_FIELD   = "body"
+)
+
+/*
+
+	Filter is a subscription filter over the headers and the JSON body of a
+	published message, for example
+
+		header.region == "eu" && (body.amount >= 100 || !body.test)
+
+	Fields are header.<name>, compared case-insensitively, and body.<path>
+	with a dot separated path into the JSON body. A field alone is true when
+	it is present and not empty, false, 0 or null. A missing field only
+	equals null.
+
+*/
+
+type Filter struct {
+	expr string
+	root node
+}
+
+func Parse(expr string) (*Filter, error) {
+	p := &parser{lexer: createLexer(expr), expr: expr}
+
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{expr: expr, root: root}, nil
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+func (f *Filter) Match(msg *Message) bool {
+	return truthy(f.root.eval(msg))
+}
+
+type Message struct {
+	headers map[string]string
+	body    []byte
+
+	decoded bool
+	doc     interface{}
+}
+
+func CreateMessage(headers map[string]string, body []byte) *Message {
+	lower := make(map[string]string, len(headers))
+	for name, value := range headers {
+		lower[strings.ToLower(name)] = value
+	}
+
+	return &Message{headers: lower, body: body}
+}
+
+func (m *Message) header(name string) (interface{}, bool) {
+	value, ok := m.headers[strings.ToLower(name)]
+	if !ok {
+		return nil, false
+	}
+
+	return value, true
+}
+
+// field looks a path up in the JSON body, the body is decoded once on first
+// use and a body that is not JSON has no fields.
+func (m *Message) field(path []string) (interface{}, bool) {
+	if !m.decoded {
+		m.decoded = true
+		if err := json.Unmarshal(m.body, &m.doc); err != nil {
+			m.doc = nil
+		}
+	}
+
+	current := m.doc
+	for _, key := range path {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if current, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// Cache keeps parsed filters by expression, members gossip expressions and
+// the same ones are evaluated on every publish.
+type Cache struct {
+	filters map[string]*Filter
+	lock    sync.RWMutex
+}
+
+func CreateCache() *Cache {
+	return &Cache{filters: make(map[string]*Filter)}
+}
+
+func (c *Cache) Get(expr string) (*Filter, error) {
+	c.lock.RLock()
+	filter, ok := c.filters[expr]
+	c.lock.RUnlock()
+
+	if ok {
+		return filter, nil
+	}
+
+	filter, err := Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	c.filters[expr] = filter
+	c.lock.Unlock()
+
+	return filter, nil
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != "" && v != "false" && v != "0"
+	case float64:
+		return v != 0
+	default:
+		return true
+	}
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func compare(op string, left interface{}, right interface{}) bool {
+	if left == nil || right == nil {
+		if op == OP_EQ {
+			return left == nil && right == nil
+		} else if op == OP_NE {
+			return (left == nil) != (right == nil)
+		}
+
+		return false
+	}
+
+	_, leftNum := left.(float64)
+	_, rightNum := right.(float64)
+
+	if leftNum || rightNum {
+		l, lok := toNumber(left)
+		r, rok := toNumber(right)
+		if lok && rok {
+			return compareNumber(op, l, r)
+		}
+	}
+
+	if l, ok := left.(bool); ok {
+		if r, ok := right.(bool); ok {
+			switch op {
+			case OP_EQ:
+				return l == r
+			case OP_NE:
+				return l != r
+			}
+			return false
+		}
+	}
+
+	l, lok := left.(string)
+	r, rok := right.(string)
+	if !lok || !rok {
+		l, r = toString(left), toString(right)
+	}
+
+	switch op {
+	case OP_EQ:
+		return l == r
+	case OP_NE:
+		return l != r
+	case OP_LT:
+		return l < r
+	case OP_LE:
+		return l <= r
+	case OP_GT:
+		return l > r
+	case OP_GE:
+		return l >= r
+	}
+
+	return false
+}
+
+func compareNumber(op string, l float64, r float64) bool {
+	switch op {
+	case OP_EQ:
+		return l == r
+	case OP_NE:
+		return l != r
+	case OP_LT:
+		return l < r
+	case OP_LE:
+		return l <= r
+	case OP_GT:
+		return l > r
+	case OP_GE:
+		return l >= r
+	}
+
+	return false
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
@@ -0,0 +1,399 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	OP_EQ  = "=="
+	OP_NE  = "!="
+	OP_LT  = "<"
+	OP_LE  = "<="
+	OP_GT  = ">"
+	OP_GE  = ">="
+	OP_AND = "&&"
+	OP_OR  = "||"
+	OP_NOT = "!"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+type lexer struct {
+	input []rune
+	pos   int
+}
+
+func createLexer(input string) *lexer {
+	return &lexer{input: []rune(input)}
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(l.input[l.pos]) {
+		l.pos++
+	}
+
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+
+	c := l.input[l.pos]
+
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokenLParen, value: "(", pos: start}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokenRParen, value: ")", pos: start}, nil
+	case c == '"' || c == '\'':
+		return l.readString(c)
+	case unicode.IsDigit(c) || (c == '-' && l.pos+1 < len(l.input) && unicode.IsDigit(l.input[l.pos+1])):
+		l.pos++
+		for l.pos < len(l.input) && (unicode.IsDigit(l.input[l.pos]) || l.input[l.pos] == '.') {
+			l.pos++
+		}
+		return token{kind: tokenNumber, value: string(l.input[start:l.pos]), pos: start}, nil
+	case unicode.IsLetter(c) || c == '_':
+		for l.pos < len(l.input) && isIdentRune(l.input[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokenIdent, value: string(l.input[start:l.pos]), pos: start}, nil
+	}
+
+	for _, op := range []string{OP_EQ, OP_NE, OP_LE, OP_GE, OP_AND, OP_OR, OP_LT, OP_GT, OP_NOT} {
+		if strings.HasPrefix(string(l.input[l.pos:]), op) {
+			l.pos += len(op)
+			return token{kind: tokenOp, value: op, pos: start}, nil
+		}
+	}
+
+	return token{}, errorAt(string(l.input), start, fmt.Sprintf("unexpected '%c'", c))
+}
+
+func (l *lexer) readString(quote rune) (token, error) {
+	start := l.pos
+	l.pos++
+
+	var value strings.Builder
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		l.pos++
+
+		if c == quote {
+			return token{kind: tokenString, value: value.String(), pos: start}, nil
+		}
+
+		if c == '\\' && l.pos < len(l.input) {
+			c = l.input[l.pos]
+			l.pos++
+		}
+
+		value.WriteRune(c)
+	}
+
+	return token{}, errorAt(string(l.input), start, "unterminated string")
+}
+
+func isIdentRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '-' || c == '.'
+}
+
+/*
+	expr       := and ('||' and)*
+	and        := unary ('&&' unary)*
+	unary      := '!' unary | primary
+	primary    := '(' expr ')' | operand (compare operand)?
+	operand    := field | string | number | true | false | null
+*/
+
+type parser struct {
+	lexer *lexer
+	expr  string
+	tok   token
+}
+
+func (p *parser) parse() (node, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokenEOF {
+		return nil, errorAt(p.expr, p.tok.pos, "unexpected '"+p.tok.value+"'")
+	}
+
+	return root, nil
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.tok.kind == tokenOp && p.tok.value == OP_OR {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.tok.kind == tokenOp && p.tok.value == OP_AND {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.tok.kind == tokenOp && p.tok.value == OP_NOT {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &notNode{operand}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.tok.kind == tokenLParen {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind != tokenRParen {
+			return nil, errorAt(p.expr, p.tok.pos, "expect ')'")
+		}
+
+		return inner, p.advance()
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokenOp || !isCompare(p.tok.value) {
+		return left, nil
+	}
+
+	op := p.tok.value
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	return &compareNode{op, left, right}, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	tok := p.tok
+
+	switch tok.kind {
+	case tokenString:
+		return &literalNode{tok.value}, p.advance()
+	case tokenNumber:
+		n, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, errorAt(p.expr, tok.pos, "invalid number '"+tok.value+"'")
+		}
+		return &literalNode{n}, p.advance()
+	case tokenIdent:
+		switch tok.value {
+		case "true":
+			return &literalNode{true}, p.advance()
+		case "false":
+			return &literalNode{false}, p.advance()
+		case "null":
+			return &literalNode{nil}, p.advance()
+		}
+
+		field, err := parseField(tok.value)
+		if err != nil {
+			return nil, errorAt(p.expr, tok.pos, err.Error())
+		}
+		return field, p.advance()
+	}
+
+	return nil, errorAt(p.expr, tok.pos, "expect a field or a value")
+}
+
+func parseField(ident string) (node, error) {
+	path := strings.Split(ident, ".")
+	if len(path) < 2 {
+		return nil, fmt.Errorf("unknown field '%s', expect header.<name> or body.<path>", ident)
+	}
+
+	for _, key := range path[1:] {
+		if key == "" {
+			return nil, fmt.Errorf("invalid field '%s'", ident)
+		}
+	}
+
+	switch path[0] {
+	case HEADER_FIELD:
+		if len(path) != 2 {
+			return nil, fmt.Errorf("invalid header '%s'", ident)
+		}
+		return &headerNode{path[1]}, nil
+	case BODY_FIELD:
+		return &bodyNode{path[1:]}, nil
+	}
+
+	return nil, fmt.Errorf("unknown field '%s', expect header.<name> or body.<path>", ident)
+}
+
+func isCompare(op string) bool {
+	switch op {
+	case OP_EQ, OP_NE, OP_LT, OP_LE, OP_GT, OP_GE:
+		return true
+	}
+
+	return false
+}
+
+func errorAt(expr string, pos int, cause string) error {
+	return util.CreateInvalidArgs("filter", fmt.Sprintf("%s (at %d: %s)", expr, pos, cause))
+}
+
+type node interface {
+	eval(msg *Message) interface{}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(msg *Message) interface{} {
+	return n.value
+}
+
+type headerNode struct {
+	name string
+}
+
+func (n *headerNode) eval(msg *Message) interface{} {
+	value, _ := msg.header(n.name)
+	return value
+}
+
+type bodyNode struct {
+	path []string
+}
+
+func (n *bodyNode) eval(msg *Message) interface{} {
+	value, _ := msg.field(n.path)
+	return value
+}
+
+type compareNode struct {
+	op    string
+	left  node
+	right node
+}
+
+func (n *compareNode) eval(msg *Message) interface{} {
+	return compare(n.op, n.left.eval(msg), n.right.eval(msg))
+}
+
+type andNode struct {
+	left  node
+	right node
+}
+
+func (n *andNode) eval(msg *Message) interface{} {
+	return truthy(n.left.eval(msg)) && truthy(n.right.eval(msg))
+}
+
+type orNode struct {
+	left  node
+	right node
+}
+
+func (n *orNode) eval(msg *Message) interface{} {
+	return truthy(n.left.eval(msg)) || truthy(n.right.eval(msg))
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(msg *Message) interface{} {
+	return !truthy(n.operand.eval(msg))
+}
@@ -0,0 +1,146 @@
+package health
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	CHECK_HTTP   = "http"
+	CHECK_TCP    = "tcp"
+	CHECK_SCRIPT = "script"
+)
+
+// Check probes a service once, a nil error means the service is healthy.
+type Check interface {
+	Run(ctx context.Context) error
+	String() string
+}
+
+type Definition struct {
+	HTTP   string
+	TCP    string
+	Script []string
+
+	// contact point of the service probed when nothing else is, it only
+	// has to answer.
+	ContactPoint string
+}
+
+// CreateCheck builds the one check a definition describes.
+func CreateCheck(def *Definition) (Check, error) {
+	count := 0
+	for _, set := range []bool{def.HTTP != "", def.TCP != "", len(def.Script) > 0, def.ContactPoint != ""} {
+		if set {
+			count++
+		}
+	}
+
+	if count != 1 {
+		return nil, util.CreateInvalidArgs("check", "expect exactly one of http, tcp or script")
+	}
+
+	switch {
+	case def.HTTP != "":
+		return CreateHTTPCheck(def.HTTP), nil
+	case def.ContactPoint != "":
+		return CreateAnswerCheck(def.ContactPoint), nil
+	case def.TCP != "":
+		if _, _, err := net.SplitHostPort(def.TCP); err != nil {
+			return nil, util.CreateInvalidArgs(CHECK_TCP, def.TCP)
+		}
+		return CreateTCPCheck(def.TCP), nil
+	}
+
+	return CreateScriptCheck(def.Script), nil
+}
+
+// HTTPCheck is healthy when a GET on its url answers a 2xx status, or any
+// status below 500 when it only checks the url answers.
+type HTTPCheck struct {
+	url        string
+	answerOnly bool
+}
+
+func CreateHTTPCheck(url string) *HTTPCheck {
+	return &HTTPCheck{url: url}
+}
+
+// CreateAnswerCheck probes a url that is not meant for GET, like the
+// contact point a service takes its messages on with PUT.
+func CreateAnswerCheck(url string) *HTTPCheck {
+	return &HTTPCheck{url: url, answerOnly: true}
+}
+
+func (c *HTTPCheck) Run(ctx context.Context) error {
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if c.answerOnly && resp.StatusCode < http.StatusInternalServerError {
+		return nil
+	}
+
+	if !util.IsSuccessStatus(resp.StatusCode) {
+		return util.CreateHTTPStatusErr(c.url, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *HTTPCheck) String() string {
+	return CHECK_HTTP + " " + c.url
+}
+
+// TCPCheck is healthy when a connection to its address is accepted.
+type TCPCheck struct {
+	addr string
+}
+
+func CreateTCPCheck(addr string) *TCPCheck {
+	return &TCPCheck{addr: addr}
+}
+
+func (c *TCPCheck) Run(ctx context.Context) error {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func (c *TCPCheck) String() string {
+	return CHECK_TCP + " " + c.addr
+}
+
+// ScriptCheck is healthy when its command exits with status 0.
+type ScriptCheck struct {
+	args []string
+}
+
+func CreateScriptCheck(args []string) *ScriptCheck {
+	return &ScriptCheck{args: args}
+}
+
+func (c *ScriptCheck) Run(ctx context.Context) error {
+	return exec.CommandContext(ctx, c.args[0], c.args[1:]...).Run()
+}
+
+func (c *ScriptCheck) String() string {
+	return CHECK_SCRIPT + " " + strings.Join(c.args, " ")
+}
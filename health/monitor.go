@@ -0,0 +1,118 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+
+	Monitor runs a check every interval. The service turns unhealthy after
+	threshold consecutive failures and healthy again on the first success,
+	onChange is called on every turn.
+
+*/
+
+type Monitor struct {
+	check     Check
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+
+	onChange func(healthy bool, err error)
+
+	healthy  bool
+	failures int
+	lastErr  error
+	lock     sync.Mutex
+
+	stopCh chan struct{}
+	once   sync.Once
+}
+
+func CreateMonitor(check Check, interval time.Duration, timeout time.Duration, threshold int, onChange func(healthy bool, err error)) *Monitor {
+	if threshold <= 0 {
+		threshold = 1
+	}
+
+	return &Monitor{
+		check:     check,
+		interval:  interval,
+		timeout:   timeout,
+		threshold: threshold,
+		onChange:  onChange,
+		healthy:   true,
+		stopCh:    make(chan struct{}),
+	}
+}
+
+func (m *Monitor) Start() {
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			m.run()
+
+			select {
+			case <-ticker.C:
+			case <-m.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (m *Monitor) Stop() {
+	m.once.Do(func() {
+		close(m.stopCh)
+	})
+}
+
+// Status returns whether the service is healthy and the last failure.
+func (m *Monitor) Status() (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.healthy, m.lastErr
+}
+
+func (m *Monitor) String() string {
+	return m.check.String()
+}
+
+func (m *Monitor) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	err := m.check.Run(ctx)
+	cancel()
+
+	select {
+	case <-m.stopCh:
+		return
+	default:
+	}
+
+	m.lock.Lock()
+
+	m.lastErr = err
+	if err == nil {
+		m.failures = 0
+	} else {
+		m.failures++
+	}
+
+	changed := false
+	if err == nil && !m.healthy {
+		m.healthy, changed = true, true
+	} else if err != nil && m.healthy && m.failures >= m.threshold {
+		m.healthy, changed = false, true
+	}
+
+	healthy := m.healthy
+	m.lock.Unlock()
+
+	if changed {
+		m.onChange(healthy, err)
+	}
+}
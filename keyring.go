@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/codegangsta/cli"
+	"github.com/soulski/dmp/api"
+	"github.com/soulski/dmp/api/req"
+	"github.com/soulski/dmp/discovery"
+)
+
+const (
+	DEFAULT_HTTP_ADDR = "127.0.0.1:8080"
+)
+
+var keygenCommand = cli.Command{
+	Name:   "keygen",
+	Usage:  "generate a gossip encryption key",
+	Action: keygen,
+}
+
+var keyringCommand = cli.Command{
+	Name:  "keyring",
+	Usage: "list, install, use or remove gossip encryption keys of the cluster",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "http-addr",
+			Value: DEFAULT_HTTP_ADDR,
+			Usage: "Address of the HTTP API of a running node",
+		},
+		cli.StringFlag{
+			Name:  "token",
+			Usage: "Bearer token of the API caller when the API requires authentication",
+		},
+		cli.BoolFlag{
+			Name:  "list",
+			Usage: "List the keys installed in the cluster",
+		},
+		cli.StringFlag{
+			Name:  "install",
+			Usage: "Install a key on every node",
+		},
+		cli.StringFlag{
+			Name:  "use",
+			Usage: "Make an installed key the primary key of every node",
+		},
+		cli.StringFlag{
+			Name:  "remove",
+			Usage: "Remove a key from every node",
+		},
+	},
+	Action: keyring,
+}
+
+func keygen(c *cli.Context) {
+	key, err := discovery.GenerateKey()
+	if err != nil {
+		fmt.Printf("Error occur : %s", err)
+		return
+	}
+
+	fmt.Println(key)
+}
+
+// keyring rotates keys with --install, --use and then --remove of the old
+// key, one node's API runs the operation on the whole cluster.
+func keyring(c *cli.Context) {
+	url := "http://" + c.String("http-addr") + "/keyring"
+
+	var method, key string
+	switch {
+	case c.String("install") != "":
+		method, key = "POST", c.String("install")
+	case c.String("use") != "":
+		method, key = "PUT", c.String("use")
+	case c.String("remove") != "":
+		method, key = "DELETE", c.String("remove")
+	case c.Bool("list"):
+		method = "GET"
+	default:
+		cli.ShowCommandHelp(c, "keyring")
+		return
+	}
+
+	var body []byte
+	if key != "" {
+		body, _ = json.Marshal(&req.Key{Key: key})
+	}
+
+	httpReq, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Error occur : %s", err)
+		return
+	}
+
+	if token := c.String("token"); token != "" {
+		httpReq.Header.Set(api.AUTHORIZATION_HEADER, api.BEARER_SCHEME+" "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		fmt.Printf("Error occur : %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Printf("Error occur : %s", err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Error occur : %s\n", resp.Status)
+	}
+
+	fmt.Println(string(result))
+}
@@ -0,0 +1,241 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/soulski/dmp/util"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	COMM      = "comm"
+	DISCOVERY = "discovery"
+	API       = "api"
+	DMP       = "dmp"
+
+	FORMAT_JSON   = "json"
+	FORMAT_LOGFMT = "logfmt"
+
+	DEFAULT_FORMAT = FORMAT_LOGFMT
+	DEFAULT_LEVEL  = "info"
+
+	SUBSYSTEM_KEY   = "subsystem"
+	CORRELATION_KEY = "correlation_id"
+	TRACE_KEY       = "trace_id"
+	ERROR_KEY       = "error"
+)
+
+var SUBSYSTEMS = []string{COMM, DISCOVERY, API, DMP}
+
+/*
+
+	Logging writes the records of every subsystem as JSON or logfmt, each
+	subsystem with its own level that can be changed while running. Fields
+	put in a context with WithFields, the correlation ID among them, are
+	added to the records logged with that context, as is the trace ID of
+	its span.
+
+*/
+
+type Logging struct {
+	handler slog.Handler
+	levels  map[string]*slog.LevelVar
+}
+
+func CreateLogging(w io.Writer, format string, level string) (*Logging, error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	var handler slog.Handler
+	switch format {
+	case FORMAT_JSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case FORMAT_LOGFMT, "":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, util.CreateInvalidArgs("log-format", format)
+	}
+
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Logging{
+		handler: handler,
+		levels:  make(map[string]*slog.LevelVar, len(SUBSYSTEMS)),
+	}
+
+	for _, subsystem := range SUBSYSTEMS {
+		l.levels[subsystem] = &slog.LevelVar{}
+		l.levels[subsystem].Set(lvl)
+	}
+
+	return l, nil
+}
+
+// Logger of a subsystem, its records carry the subsystem name.
+func (l *Logging) Logger(subsystem string) *slog.Logger {
+	level, ok := l.levels[subsystem]
+	if !ok {
+		level = l.levels[DMP]
+	}
+
+	return slog.New(&contextHandler{
+		handler: l.handler.WithAttrs([]slog.Attr{slog.String(SUBSYSTEM_KEY, subsystem)}),
+		level:   level,
+	})
+}
+
+// Levels returns the level of every subsystem.
+func (l *Logging) Levels() map[string]string {
+	levels := make(map[string]string, len(l.levels))
+	for subsystem, level := range l.levels {
+		levels[subsystem] = formatLevel(level.Level())
+	}
+
+	return levels
+}
+
+func (l *Logging) SetLevel(subsystem string, level string) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	levelVar, ok := l.levels[subsystem]
+	if !ok {
+		return util.CreateNotFoundErr("subsystem", subsystem)
+	}
+
+	levelVar.Set(lvl)
+
+	return nil
+}
+
+// SetLevels sets the level of subsystems, as parsed by ParseLevels.
+func (l *Logging) SetLevels(levels map[string]string) error {
+	for subsystem, level := range levels {
+		if err := l.SetLevel(subsystem, level); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseLevel reads debug, info, warn or error.
+func ParseLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return 0, util.CreateInvalidArgs("log level", level)
+	}
+
+	return lvl, nil
+}
+
+func formatLevel(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// ParseLevels reads levels given as "<subsystem>=<level>".
+func ParseLevels(values []string) (map[string]string, error) {
+	levels := make(map[string]string, len(values))
+
+	for _, value := range values {
+		elems := strings.SplitN(value, "=", 2)
+		if len(elems) != 2 {
+			return nil, util.CreateInvalidArgs("log level", value)
+		}
+
+		if _, err := ParseLevel(elems[1]); err != nil {
+			return nil, err
+		}
+
+		levels[elems[0]] = elems[1]
+	}
+
+	return levels, nil
+}
+
+// Discard is a logger writing nowhere, for code run without logging set up.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+type fieldsKey struct{}
+
+type correlationKey struct{}
+
+// WithFields returns ctx with fields, as key value pairs, added to every
+// record logged with it.
+func WithFields(ctx context.Context, args ...any) context.Context {
+	fields, _ := ctx.Value(fieldsKey{}).([]any)
+
+	merged := make([]any, 0, len(fields)+len(args))
+	merged = append(merged, fields...)
+	merged = append(merged, args...)
+
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// WithCorrelation returns ctx with the correlation ID of the call it
+// belongs to, empty IDs are left out.
+func WithCorrelation(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+
+	ctx = context.WithValue(ctx, correlationKey{}, id)
+	return WithFields(ctx, CORRELATION_KEY, id)
+}
+
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// NewCorrelationID is given to calls that come without one.
+func NewCorrelationID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// contextHandler filters records by the level of its subsystem and adds
+// the fields of their context.
+type contextHandler struct {
+	handler slog.Handler
+	level   *slog.LevelVar
+}
+
+func (h *contextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if ctx != nil {
+		if fields, ok := ctx.Value(fieldsKey{}).([]any); ok {
+			record.Add(fields...)
+		}
+
+		if span := trace.SpanContextFromContext(ctx); span.HasTraceID() {
+			record.AddAttrs(slog.String(TRACE_KEY, span.TraceID().String()))
+		}
+	}
+
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{handler: h.handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{handler: h.handler.WithGroup(name), level: h.level}
+}
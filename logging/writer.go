@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+var prefixLevels = map[string]slog.Level{
+	"[TRACE]": slog.LevelDebug,
+	"[DEBUG]": slog.LevelDebug,
+	"[INFO]":  slog.LevelInfo,
+	"[WARN]":  slog.LevelWarn,
+	"[ERR]":   slog.LevelError,
+	"[ERROR]": slog.LevelError,
+}
+
+// Writer turns the lines of libraries logging through the standard logger,
+// as Serf and memberlist do, into records of logger. The level is read from
+// the "[DEBUG]", "[INFO]", "[WARN]" or "[ERR]" tag of a line, the time
+// before the tag is dropped.
+func Writer(logger *slog.Logger) io.Writer {
+	return &levelWriter{logger: logger}
+}
+
+type levelWriter struct {
+	logger *slog.Logger
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		level, msg := parseLine(line)
+		w.logger.Log(context.Background(), level, msg)
+	}
+
+	return len(p), nil
+}
+
+func parseLine(line string) (slog.Level, string) {
+	for prefix, level := range prefixLevels {
+		if index := strings.Index(line, prefix); index >= 0 {
+			return level, strings.TrimSpace(line[index+len(prefix):])
+		}
+	}
+
+	return slog.LevelInfo, strings.TrimSpace(line)
+}
@@ -7,7 +7,10 @@ import (
 	"syscall"
 
 	"github.com/codegangsta/cli"
+	"github.com/soulski/dmp/comm"
+	"github.com/soulski/dmp/discovery"
 	"github.com/soulski/dmp/dmp"
+	"github.com/soulski/dmp/logging"
 )
 
 func main() {
@@ -16,6 +19,10 @@ func main() {
 	mainApp.Usage = "run decentralized message bus"
 	mainApp.Version = "0.1.0"
 	mainApp.Action = action
+	mainApp.Commands = []cli.Command{
+		keygenCommand,
+		keyringCommand,
+	}
 	mainApp.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "name, n",
@@ -53,30 +60,293 @@ func main() {
 			Name:  "net-if",
 			Usage: "Network interface",
 		},
+		cli.Int64Flag{
+			Name:  "max-frame-size",
+			Value: comm.DEFAULT_MAX_BODY_SIZE,
+			Usage: "Largest message body in bytes accepted in one comm frame",
+		},
+		cli.Int64Flag{
+			Name:  "max-message-size",
+			Value: comm.DEFAULT_MAX_MESSAGE_SIZE,
+			Usage: "Largest message body in bytes taken by the API or joined back from streamed comm frames",
+		},
+		cli.IntFlag{
+			Name:  "chunk-size",
+			Value: comm.DEFAULT_CHUNK_SIZE,
+			Usage: "Message bodies larger than this are streamed in chunks",
+		},
+		cli.DurationFlag{
+			Name:  "request-timeout",
+			Value: dmp.DEFAULT_REQUEST_TIMEOUT,
+			Usage: "Default time to wait for a reply or for the contact point to answer",
+		},
+		cli.IntFlag{
+			Name:  "request-retries",
+			Value: dmp.DEFAULT_REQUEST_RETRIES,
+			Usage: "Times a failed request is retried on another member of the namespace",
+		},
+		cli.DurationFlag{
+			Name:  "retry-backoff",
+			Value: dmp.DEFAULT_RETRY_BACKOFF,
+			Usage: "Wait before the first retry, doubled on every further retry",
+		},
+		cli.StringFlag{
+			Name:  "balancer",
+			Value: dmp.ROUND_ROBIN,
+			Usage: "Default load balancing strategy (round-robin, random, least-outstanding, weighted, hash)",
+		},
+		cli.StringSliceFlag{
+			Name:  "ns-balancer",
+			Usage: "Load balancing strategy of one namespace as namespace=strategy",
+		},
+		cli.IntFlag{
+			Name:  "weight",
+			Value: discovery.DEFAULT_WEIGHT,
+			Usage: "Weight of this node for weighted load balancing",
+		},
+		cli.IntFlag{
+			Name:  "breaker-threshold",
+			Value: dmp.DEFAULT_BREAKER_THRESHOLD,
+			Usage: "Consecutive failures before a member is ejected, 0 disables circuit breaking",
+		},
+		cli.DurationFlag{
+			Name:  "breaker-cooldown",
+			Value: dmp.DEFAULT_BREAKER_COOLDOWN,
+			Usage: "Time an ejected member is left out before it is probed again",
+		},
+		cli.DurationFlag{
+			Name:  "breaker-slow-call",
+			Usage: "Calls slower than this count as failures (default disabled)",
+		},
+		cli.StringFlag{
+			Name:  "queue-dir",
+			Usage: "Directory of the notification write-ahead log, notifications are acked once persisted (default disabled, acked once delivered)",
+		},
+		cli.DurationFlag{
+			Name:  "redelivery-backoff",
+			Value: dmp.DEFAULT_REDELIVERY_BACKOFF,
+			Usage: "Wait before redelivering a persisted notification, doubled on every failure",
+		},
+		cli.IntFlag{
+			Name:  "max-redeliveries",
+			Usage: "Deliveries of a persisted notification before it moves to the dead-letter queue (default 0, redeliver until delivered)",
+		},
+		cli.IntFlag{
+			Name:  "dead-letter-limit",
+			Value: dmp.DEFAULT_DEAD_LETTER_LIMIT,
+			Usage: "Dead letters kept, the oldest is dropped to make room for a new one",
+		},
+		cli.StringFlag{
+			Name:  "encrypt",
+			Usage: "Base64 gossip encryption key, nodes without it cannot join (see keygen)",
+		},
+		cli.StringFlag{
+			Name:  "keyring-file",
+			Usage: "File keeping gossip keys installed at runtime, its keys are loaded on start",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "Certificate file of this node for mutual TLS on the comm bus (default disabled)",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "Private key file of the comm bus certificate",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "CA file peer certificates of the comm bus are verified against",
+		},
+		cli.StringFlag{
+			Name:  "api-auth-file",
+			Usage: "JSON file of API tokens, HMAC keys and ACL policies (default disabled, every caller allowed)",
+		},
+		cli.StringFlag{
+			Name:  "otlp-endpoint",
+			Usage: "host:port of the OTLP/HTTP collector traces are exported to (default disabled)",
+		},
+		cli.StringFlag{
+			Name:  "recv-policy",
+			Usage: "JSON file of the source namespaces local services take messages from (default every source)",
+		},
+		cli.StringFlag{
+			Name:  "api-tls-cert",
+			Usage: "Certificate file to serve the HTTP API over TLS (default plain HTTP)",
+		},
+		cli.StringFlag{
+			Name:  "api-tls-key",
+			Usage: "Private key file of the HTTP API certificate",
+		},
+		cli.StringFlag{
+			Name:  "api-tls-ca",
+			Usage: "CA file client certificates of API callers are verified against",
+		},
+		cli.DurationFlag{
+			Name:  "check-interval",
+			Value: dmp.DEFAULT_CHECK_INTERVAL,
+			Usage: "Default interval between health checks of a registered service",
+		},
+		cli.DurationFlag{
+			Name:  "check-timeout",
+			Value: dmp.DEFAULT_CHECK_TIMEOUT,
+			Usage: "Default time a health check may take before it fails",
+		},
+		cli.IntFlag{
+			Name:  "check-threshold",
+			Value: dmp.DEFAULT_CHECK_THRESHOLD,
+			Usage: "Default consecutive failed health checks before a service is suspect",
+		},
+		cli.StringSliceFlag{
+			Name:  "check-script",
+			Usage: "Command services may name as script check, as name=command args..., may be repeated",
+		},
+		cli.StringFlag{
+			Name:  "comm-host",
+			Usage: "Host the comm bus listens on (default bind-host)",
+		},
+		cli.IntFlag{
+			Name:  "comm-port",
+			Value: dmp.DEFAULT_COMM_PORT,
+			Usage: "Port the comm bus listens on",
+		},
+		cli.BoolFlag{
+			Name:  "comm-port-fallback",
+			Usage: "Listen on a random port when comm-port is taken instead of failing to start",
+		},
+		cli.StringFlag{
+			Name:  "api-host",
+			Usage: "Host the HTTP API listens on (default every interface)",
+		},
+		cli.IntFlag{
+			Name:  "api-port",
+			Value: dmp.DEFAULT_API_PORT,
+			Usage: "Port the HTTP API listens on",
+		},
+		cli.StringFlag{
+			Name:  "api-socket",
+			Usage: "Unix socket the HTTP API is also served on, for services on the same host (default disabled)",
+		},
+		cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Value: dmp.DEFAULT_SHUTDOWN_TIMEOUT,
+			Usage: "Time a stopping node waits for in-flight calls and queued notifications to drain",
+		},
+		cli.DurationFlag{
+			Name:  "leave-propagation",
+			Value: dmp.DEFAULT_LEAVE_PROPAGATION,
+			Usage: "Time a stopping node keeps serving after it gossips leaving, so peers stop sending to it",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Value: logging.DEFAULT_FORMAT,
+			Usage: "Format of log records, json or logfmt",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: logging.DEFAULT_LEVEL,
+			Usage: "Level of every subsystem, debug, info, warn or error",
+		},
+		cli.StringSliceFlag{
+			Name:  "log-subsystem",
+			Usage: "Level of a subsystem (comm, discovery, api or dmp) as subsystem=level, may be repeated",
+		},
 	}
 
 	mainApp.Run(os.Args)
 }
 
-func readConfig(c *cli.Context) *dmp.Config {
+func readConfig(c *cli.Context) (*dmp.Config, error) {
+	balancers, err := dmp.ParseBalancers(c.StringSlice("ns-balancer"))
+	if err != nil {
+		return nil, err
+	}
+
+	logLevels, err := logging.ParseLevels(c.StringSlice("log-subsystem"))
+	if err != nil {
+		return nil, err
+	}
+
+	checkScripts, err := dmp.ParseCheckScripts(c.StringSlice("check-script"))
+	if err != nil {
+		return nil, err
+	}
+
 	conf := &dmp.Config{
-		NodeName:      c.String("name"),
-		BindAddr:      c.String("bind-host"),
-		BindPort:      c.Int("bind-port"),
-		NetworkType:   c.String("network"),
-		ContactPoints: c.StringSlice("contacts"),
-		ContactCIDR:   c.String("contact-cidr"),
-		Namespace:     c.String("namespace"),
-		NetInterface:  c.String("net-if"),
+		NodeName:       c.String("name"),
+		BindAddr:       c.String("bind-host"),
+		BindPort:       c.Int("bind-port"),
+		NetworkType:    c.String("network"),
+		ContactPoints:  c.StringSlice("contacts"),
+		ContactCIDR:    c.String("contact-cidr"),
+		Namespace:      c.String("namespace"),
+		NetInterface:   c.String("net-if"),
+		MaxFrameSize:   c.Int64("max-frame-size"),
+		MaxMessageSize: c.Int64("max-message-size"),
+		ChunkSize:      c.Int("chunk-size"),
+		RequestTimeout: c.Duration("request-timeout"),
+		RequestRetries: c.Int("request-retries"),
+		RetryBackoff:   c.Duration("retry-backoff"),
+
+		DefaultBalancer: c.String("balancer"),
+		Balancers:       balancers,
+		Weight:          c.Int("weight"),
+
+		BreakerThreshold: c.Int("breaker-threshold"),
+		BreakerCooldown:  c.Duration("breaker-cooldown"),
+		BreakerSlowCall:  c.Duration("breaker-slow-call"),
+
+		QueueDir:          c.String("queue-dir"),
+		RedeliveryBackoff: c.Duration("redelivery-backoff"),
+		MaxRedeliveries:   c.Int("max-redeliveries"),
+
+		DeadLetterLimit: c.Int("dead-letter-limit"),
+
+		EncryptKey:  c.String("encrypt"),
+		KeyringFile: c.String("keyring-file"),
+
+		TLSCertFile: c.String("tls-cert"),
+		TLSKeyFile:  c.String("tls-key"),
+		TLSCAFile:   c.String("tls-ca"),
+
+		APIAuthFile:    c.String("api-auth-file"),
+		RecvPolicyFile: c.String("recv-policy"),
+		APITLSCertFile: c.String("api-tls-cert"),
+		APITLSKeyFile:  c.String("api-tls-key"),
+		APITLSCAFile:   c.String("api-tls-ca"),
+
+		OTLPEndpoint: c.String("otlp-endpoint"),
+
+		CheckInterval:  c.Duration("check-interval"),
+		CheckTimeout:   c.Duration("check-timeout"),
+		CheckThreshold: c.Int("check-threshold"),
+		CheckScripts:   checkScripts,
+
+		ShutdownTimeout:  c.Duration("shutdown-timeout"),
+		LeavePropagation: c.Duration("leave-propagation"),
+
+		CommBindAddr:     c.String("comm-host"),
+		CommPort:         c.Int("comm-port"),
+		CommPortFallback: c.Bool("comm-port-fallback"),
+
+		APIBindAddr: c.String("api-host"),
+		APIPort:     c.Int("api-port"),
+		APISocket:   c.String("api-socket"),
+
+		LogFormat: c.String("log-format"),
+		LogLevel:  c.String("log-level"),
+		LogLevels: logLevels,
 	}
 
 	conf.Merge(dmp.DefaultConfig())
 
-	return conf
+	return conf, nil
 }
 
 func action(c *cli.Context) {
-	conf := readConfig(c)
+	conf, err := readConfig(c)
+	if err != nil {
+		fmt.Printf("Error occur : %s", err)
+		return
+	}
 
 	if conf.BindAddr == "0.0.0.0" && conf.NetInterface != "" {
 		bindAddr, err := conf.GetBindAddr()
@@ -96,20 +366,24 @@ func action(c *cli.Context) {
 
 	err = dmp.Start()
 	if err == nil {
-		shutdownCh := make(chan os.Signal, 1)
-		signal.Notify(shutdownCh, os.Interrupt)
+		shutdownCh := make(chan os.Signal, 2)
+		signal.Notify(shutdownCh, os.Interrupt, syscall.SIGTERM)
 
-		for sig := range shutdownCh {
-			fmt.Println(sig)
+		sig := <-shutdownCh
+		fmt.Printf("Got %s, shutting down...\n", sig)
 
-			if sig == syscall.SIGINT {
-				if err := dmp.Stop(); err != nil {
-					fmt.Printf("Error occur : %s", err)
-				}
+		// a second signal does not wait for the drain.
+		go func() {
+			<-shutdownCh
+			os.Exit(1)
+		}()
 
-				os.Exit(0)
-			}
+		if err := dmp.Stop(); err != nil {
+			fmt.Printf("Error occur : %s", err)
+			os.Exit(1)
 		}
+
+		os.Exit(0)
 	} else {
 		fmt.Printf("Error occur : %s", err)
 	}
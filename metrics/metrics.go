@@ -0,0 +1,263 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	NAMESPACE = "dmp"
+
+	KIND_REQUEST      = "request"
+	KIND_NOTIFICATION = "notification"
+	KIND_PUBLISH      = "publish"
+
+	OUTCOME_OK        = "ok"
+	OUTCOME_TIMEOUT   = "timeout"
+	OUTCOME_FORBIDDEN = "forbidden"
+	OUTCOME_ERROR     = "error"
+
+	SENT     = "sent"
+	RECEIVED = "received"
+
+	// status of a forward to a contact point that got no response.
+	STATUS_NONE = "none"
+
+	// label of a namespace no member registered, or a topic no member
+	// subscribed as is.
+	OTHER = "other"
+)
+
+/*
+
+	Metrics of the node, exposed in the Prometheus text format by Handler.
+	Messages are counted per kind, target namespace and topic, the topic is
+	empty unless the message was published. Callers pick namespaces and
+	topics, so only namespaces registered in the cluster and topics
+	subscribed as is are labelled by name, any other is labelled OTHER. The
+	member counts are read from discovery on every scrape.
+
+*/
+
+var (
+	registry = prometheus.NewRegistry()
+
+	messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "messages_total",
+		Help:      "Messages sent by this node per kind, namespace, topic and outcome.",
+	}, []string{"kind", "namespace", "topic", "outcome"})
+
+	messageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "message_duration_seconds",
+		Help:      "Time to deliver a message sent by this node, retries included.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kind", "namespace", "topic"})
+
+	frameSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "comm",
+		Name:      "frame_bytes",
+		Help:      "Size of comm frames, header included.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+	}, []string{"direction"})
+
+	dialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "comm",
+		Name:      "dial_errors_total",
+		Help:      "Failed dials to peers, by the step that failed.",
+	}, []string{"step"})
+
+	receiveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "comm",
+		Name:      "receive_duration_seconds",
+		Help:      "Time to handle a received message until it is replied.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"namespace", "outcome"})
+
+	connections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "comm",
+		Name:      "connections",
+		Help:      "Connections accepted by the comm bus and still open.",
+	})
+
+	contactPoints = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "contact_point",
+		Name:      "requests_total",
+		Help:      "Messages forwarded to local services, by HTTP status.",
+	}, []string{"namespace", "status"})
+
+	contactPointDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "contact_point",
+		Name:      "duration_seconds",
+		Help:      "Time local services take to answer a forwarded message.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"namespace"})
+
+	labels = &labelSource{}
+
+	members = &memberCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(NAMESPACE, "discovery", "members"),
+			"Members of the cluster by status.",
+			[]string{"status"}, nil,
+		),
+	}
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		messages, messageDuration,
+		frameSize, dialErrors, receiveDuration, connections,
+		contactPoints, contactPointDuration,
+		members,
+	)
+}
+
+// Handler serves the metrics of the node.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Outcome labels the result of a message by its error.
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return OUTCOME_OK
+	case util.IsTimeout(err):
+		return OUTCOME_TIMEOUT
+	case util.IsForbidden(err):
+		return OUTCOME_FORBIDDEN
+	}
+
+	return OUTCOME_ERROR
+}
+
+func ObserveMessage(kind string, namespace string, topic string, err error, elapsed time.Duration) {
+	namespace, topic = labels.namespace(namespace), labels.topic(topic)
+
+	messages.WithLabelValues(kind, namespace, topic, Outcome(err)).Inc()
+	messageDuration.WithLabelValues(kind, namespace, topic).Observe(elapsed.Seconds())
+}
+
+func ObserveFrame(direction string, size int) {
+	frameSize.WithLabelValues(direction).Observe(float64(size))
+}
+
+func DialError(step string) {
+	dialErrors.WithLabelValues(step).Inc()
+}
+
+func ObserveReceive(namespace string, err error, elapsed time.Duration) {
+	receiveDuration.WithLabelValues(labels.namespace(namespace), Outcome(err)).Observe(elapsed.Seconds())
+}
+
+func ConnectionOpened() {
+	connections.Inc()
+}
+
+func ConnectionClosed() {
+	connections.Dec()
+}
+
+// ObserveContactPoint records a forward to a local service, status is 0
+// when the service did not answer.
+func ObserveContactPoint(namespace string, status int, elapsed time.Duration) {
+	label := STATUS_NONE
+	if status != 0 {
+		label = strconv.Itoa(status)
+	}
+
+	namespace = labels.namespace(namespace)
+
+	contactPoints.WithLabelValues(namespace, label).Inc()
+	contactPointDuration.WithLabelValues(namespace).Observe(elapsed.Seconds())
+}
+
+// SetMemberSource gives the function member counts by status are read from
+// on every scrape.
+func SetMemberSource(count func() map[string]int) {
+	members.lock.Lock()
+	defer members.lock.Unlock()
+
+	members.count = count
+}
+
+// SetLabelSource gives the functions telling whether a namespace is
+// registered and a topic subscribed as is, values are labelled as given
+// until it is called.
+func SetLabelSource(namespace func(string) bool, topic func(string) bool) {
+	labels.lock.Lock()
+	defer labels.lock.Unlock()
+
+	labels.hasNamespace = namespace
+	labels.hasTopic = topic
+}
+
+type labelSource struct {
+	hasNamespace func(string) bool
+	hasTopic     func(string) bool
+	lock         sync.RWMutex
+}
+
+func (l *labelSource) namespace(namespace string) string {
+	l.lock.RLock()
+	has := l.hasNamespace
+	l.lock.RUnlock()
+
+	if namespace == "" || has == nil || has(namespace) {
+		return namespace
+	}
+
+	return OTHER
+}
+
+func (l *labelSource) topic(topic string) string {
+	l.lock.RLock()
+	has := l.hasTopic
+	l.lock.RUnlock()
+
+	if topic == "" || has == nil || has(topic) {
+		return topic
+	}
+
+	return OTHER
+}
+
+type memberCollector struct {
+	desc  *prometheus.Desc
+	count func() map[string]int
+	lock  sync.Mutex
+}
+
+func (c *memberCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *memberCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	count := c.count
+	c.lock.Unlock()
+
+	if count == nil {
+		return
+	}
+
+	for status, n := range count() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), status)
+	}
+}
@@ -0,0 +1,323 @@
+package queue
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	META_LETTER_ID    = "id"
+	META_NAMESPACE    = "namespace"
+	META_TOPIC        = "topic"
+	META_REASON       = "reason"
+	META_ATTEMPTS     = "attempts"
+	META_FIRST_FAILED = "first-failed"
+	META_LAST_FAILED  = "last-failed"
+)
+
+type DeadLetter struct {
+	ID          uint64
+	Namespace   string
+	Topic       string
+	Reason      string
+	Attempts    int
+	FirstFailed time.Time
+	LastFailed  time.Time
+	Body        []byte
+}
+
+/*
+
+	DeadLetters keeps messages that could not be delivered so they can be
+	inspected and replayed later. Letters are kept in memory, and also in a
+	WAL when a directory is given so they survive a restart. A letter keeps
+	its ID while it is rewritten in the WAL after a failed replay. At most
+	limit letters are kept, the oldest is dropped to make room for a new one.
+
+*/
+
+type DeadLetters struct {
+	wal *WAL
+
+	letters map[uint64]*DeadLetter
+	entries map[uint64]uint64
+	lastID  uint64
+	limit   int
+
+	lock sync.Mutex
+}
+
+func OpenDeadLetters(dir string, limit int) (*DeadLetters, error) {
+	if limit <= 0 {
+		return nil, util.CreateInvalidArgs("dead letter limit", strconv.Itoa(limit))
+	}
+
+	d := &DeadLetters{
+		letters: make(map[uint64]*DeadLetter),
+		entries: make(map[uint64]uint64),
+		limit:   limit,
+	}
+
+	if dir == "" {
+		return d, nil
+	}
+
+	wal, err := OpenWALFile(dir, DEADLETTER_FILE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	d.wal = wal
+
+	for _, entry := range wal.Pending() {
+		letter := decodeLetter(entry)
+
+		d.letters[letter.ID] = letter
+		d.entries[letter.ID] = entry.ID
+
+		if letter.ID > d.lastID {
+			d.lastID = letter.ID
+		}
+	}
+
+	if err := d.evict(d.limit); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *DeadLetters) Add(ns string, topic string, reason string, attempts int, body []byte) (*DeadLetter, error) {
+	now := time.Now()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.evict(d.limit - 1); err != nil {
+		return nil, err
+	}
+
+	d.lastID++
+
+	letter := &DeadLetter{
+		ID:          d.lastID,
+		Namespace:   ns,
+		Topic:       topic,
+		Reason:      reason,
+		Attempts:    attempts,
+		FirstFailed: now,
+		LastFailed:  now,
+		Body:        body,
+	}
+
+	if err := d.persist(letter); err != nil {
+		return nil, err
+	}
+
+	d.letters[letter.ID] = letter
+
+	return letter, nil
+}
+
+// List returns letters of the namespace and topic, an empty value matches
+// every namespace or topic. Letters are ordered oldest first.
+func (d *DeadLetters) List(ns string, topic string) []*DeadLetter {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	letters := []*DeadLetter{}
+	for _, letter := range d.letters {
+		if letter.match(ns, topic) {
+			letters = append(letters, letter)
+		}
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].ID < letters[j].ID
+	})
+
+	return letters
+}
+
+func (d *DeadLetters) Get(id uint64) (*DeadLetter, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	letter, ok := d.letters[id]
+	return letter, ok
+}
+
+// Failed records another failed delivery of the letter.
+func (d *DeadLetters) Failed(id uint64, reason string) (*DeadLetter, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	letter, ok := d.letters[id]
+	if !ok {
+		return nil, nil
+	}
+
+	updated := *letter
+	updated.Reason = reason
+	updated.Attempts++
+	updated.LastFailed = time.Now()
+
+	if err := d.persist(&updated); err != nil {
+		return nil, err
+	}
+
+	d.letters[id] = &updated
+
+	return &updated, nil
+}
+
+func (d *DeadLetters) Remove(id uint64) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.letters[id]; !ok {
+		return false, nil
+	}
+
+	if err := d.ack(id); err != nil {
+		return false, err
+	}
+
+	delete(d.letters, id)
+
+	return true, nil
+}
+
+// Purge removes every letter of the namespace and topic, an empty value
+// matches every namespace or topic.
+func (d *DeadLetters) Purge(ns string, topic string) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	purged := 0
+	for id, letter := range d.letters {
+		if !letter.match(ns, topic) {
+			continue
+		}
+
+		if err := d.ack(id); err != nil {
+			return purged, err
+		}
+
+		delete(d.letters, id)
+		purged++
+	}
+
+	return purged, nil
+}
+
+func (d *DeadLetters) Close() error {
+	if d.wal == nil {
+		return nil
+	}
+
+	return d.wal.Close()
+}
+
+// evict drops the oldest letters until no more than max are left.
+func (d *DeadLetters) evict(max int) error {
+	for len(d.letters) > max {
+		var oldest uint64
+		for id := range d.letters {
+			if oldest == 0 || id < oldest {
+				oldest = id
+			}
+		}
+
+		if err := d.ack(oldest); err != nil {
+			return err
+		}
+
+		delete(d.letters, oldest)
+	}
+
+	return nil
+}
+
+// persist writes the letter to the WAL, replacing the entry of an older
+// version of it.
+func (d *DeadLetters) persist(letter *DeadLetter) error {
+	if d.wal == nil {
+		return nil
+	}
+
+	entry, err := d.wal.Append(encodeLetter(letter), letter.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := d.ack(letter.ID); err != nil {
+		return err
+	}
+
+	d.entries[letter.ID] = entry.ID
+
+	return nil
+}
+
+func (d *DeadLetters) ack(id uint64) error {
+	entryID, ok := d.entries[id]
+	if !ok {
+		return nil
+	}
+
+	if err := d.wal.Ack(entryID); err != nil {
+		return err
+	}
+
+	delete(d.entries, id)
+
+	return nil
+}
+
+func (l *DeadLetter) match(ns string, topic string) bool {
+	return (ns == "" || l.Namespace == ns) && (topic == "" || l.Topic == topic)
+}
+
+func encodeLetter(letter *DeadLetter) map[string]string {
+	return map[string]string{
+		META_LETTER_ID:    strconv.FormatUint(letter.ID, 10),
+		META_NAMESPACE:    letter.Namespace,
+		META_TOPIC:        letter.Topic,
+		META_REASON:       letter.Reason,
+		META_ATTEMPTS:     strconv.Itoa(letter.Attempts),
+		META_FIRST_FAILED: letter.FirstFailed.Format(time.RFC3339Nano),
+		META_LAST_FAILED:  letter.LastFailed.Format(time.RFC3339Nano),
+	}
+}
+
+func decodeLetter(entry *Entry) *DeadLetter {
+	letter := &DeadLetter{
+		ID:          entry.ID,
+		Namespace:   entry.Meta[META_NAMESPACE],
+		Topic:       entry.Meta[META_TOPIC],
+		Reason:      entry.Meta[META_REASON],
+		FirstFailed: entry.Created,
+		LastFailed:  entry.Created,
+		Body:        entry.Body,
+	}
+
+	if id, err := strconv.ParseUint(entry.Meta[META_LETTER_ID], 10, 64); err == nil {
+		letter.ID = id
+	}
+	if attempts, err := strconv.Atoi(entry.Meta[META_ATTEMPTS]); err == nil {
+		letter.Attempts = attempts
+	}
+	if t, err := time.Parse(time.RFC3339Nano, entry.Meta[META_FIRST_FAILED]); err == nil {
+		letter.FirstFailed = t
+	}
+	if t, err := time.Parse(time.RFC3339Nano, entry.Meta[META_LAST_FAILED]); err == nil {
+		letter.LastFailed = t
+	}
+
+	return letter
+}
@@ -0,0 +1,373 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/soulski/dmp/util"
+)
+
+const (
+	WAL_FILE_NAME        = "notifications.wal"
+	DEADLETTER_FILE_NAME = "deadletter.wal"
+
+	RECORD_APPEND byte = 1
+	RECORD_ACK    byte = 2
+
+	// type, id, payload size, crc
+	RECORD_HEADER_SIZE = 1 + 8 + 4 + 4
+
+	// the log is rewritten with only pending entries once this many entries
+	// were acked since the last rewrite.
+	COMPACT_THRESHOLD = 1024
+)
+
+type Entry struct {
+	ID       uint64
+	Meta     map[string]string
+	Body     []byte
+	Created  time.Time
+	Attempts int
+}
+
+/*
+
+	WAL is an append only log of async messages. A message is appended and
+	synced before it is acked to the sender, and acked in the log once the
+	service took it. Entries appended but never acked are pending and are
+	redelivered after a restart.
+
+*/
+
+type WAL struct {
+	path string
+	file *os.File
+
+	pending map[uint64]*Entry
+	lastID  uint64
+	acked   int
+
+	lock sync.Mutex
+}
+
+func OpenWAL(dir string) (*WAL, error) {
+	return OpenWALFile(dir, WAL_FILE_NAME)
+}
+
+func OpenWALFile(dir string, name string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		path:    filepath.Join(dir, name),
+		pending: make(map[uint64]*Entry),
+	}
+
+	if err := w.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := w.compact(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *WAL) replay() error {
+	file, err := os.Open(w.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	remaining := info.Size()
+	reader := bufio.NewReader(file)
+	for {
+		rType, id, payload, err := readRecord(reader, remaining)
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			// A torn record at the tail is left over from a crash while
+			// appending, the sender never got an ack for it.
+			return nil
+		} else if err != nil {
+			// Corruption before the tail would drop every later record,
+			// acked or not. Refuse to open the log rather than compact it.
+			return err
+		}
+
+		remaining -= int64(RECORD_HEADER_SIZE + len(payload))
+
+		if id > w.lastID {
+			w.lastID = id
+		}
+
+		switch rType {
+		case RECORD_APPEND:
+			entry, err := decodeEntry(id, payload)
+			if err != nil {
+				return err
+			}
+
+			w.pending[id] = entry
+		case RECORD_ACK:
+			delete(w.pending, id)
+		}
+	}
+}
+
+func (w *WAL) Append(meta map[string]string, body []byte) (*Entry, error) {
+	entry := &Entry{
+		Meta:    meta,
+		Body:    body,
+		Created: time.Now(),
+	}
+
+	payload, err := encodeEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.lastID++
+	entry.ID = w.lastID
+
+	if err := w.writeRecord(RECORD_APPEND, entry.ID, payload); err != nil {
+		return nil, err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return nil, err
+	}
+
+	w.pending[entry.ID] = entry
+
+	return entry, nil
+}
+
+func (w *WAL) Ack(id uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, ok := w.pending[id]; !ok {
+		return nil
+	}
+
+	if err := w.writeRecord(RECORD_ACK, id, nil); err != nil {
+		return err
+	}
+
+	delete(w.pending, id)
+	w.acked++
+
+	if w.acked >= COMPACT_THRESHOLD {
+		return w.compact()
+	}
+
+	return nil
+}
+
+// Pending returns entries not acked yet, oldest first.
+func (w *WAL) Pending() []*Entry {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	entries := make([]*Entry, 0, len(w.pending))
+	for _, entry := range w.pending {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+
+	return entries
+}
+
+func (w *WAL) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
+
+// compact rewrites the log with only pending entries, the new log replaces
+// the old one atomically by rename.
+func (w *WAL) compact() error {
+	tmpPath := w.path + ".tmp"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]uint64, 0, len(w.pending))
+	for id := range w.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	buf := bufio.NewWriter(tmp)
+	for _, id := range ids {
+		payload, err := encodeEntry(w.pending[id])
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+
+		if err := writeRecord(buf, RECORD_APPEND, id, payload); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := buf.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if w.file != nil {
+		w.file.Close()
+	}
+
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		return err
+	}
+
+	w.file, err = os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0644)
+	w.acked = 0
+
+	return err
+}
+
+func (w *WAL) writeRecord(rType byte, id uint64, payload []byte) error {
+	if w.file == nil {
+		return errors.New("wal is closed")
+	}
+
+	return writeRecord(w.file, rType, id, payload)
+}
+
+func writeRecord(writer io.Writer, rType byte, id uint64, payload []byte) error {
+	record := make([]byte, RECORD_HEADER_SIZE, RECORD_HEADER_SIZE+len(payload))
+	record[0] = rType
+	binary.BigEndian.PutUint64(record[1:9], id)
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[13:17], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+
+	_, err := writer.Write(record)
+	return err
+}
+
+// readRecord reads the next record of a log with remaining bytes left. A
+// record cut short by the end of the log returns io.ErrUnexpectedEOF, any
+// other damage returns an InvalidProtocol error.
+func readRecord(reader io.Reader, remaining int64) (byte, uint64, []byte, error) {
+	header := make([]byte, RECORD_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, 0, nil, err
+	}
+
+	id := binary.BigEndian.Uint64(header[1:9])
+	size := binary.BigEndian.Uint32(header[9:13])
+	sum := binary.BigEndian.Uint32(header[13:17])
+
+	if header[0] != RECORD_APPEND && header[0] != RECORD_ACK {
+		return 0, 0, nil, util.CreateInvalidProtocol("wal record type unknown")
+	}
+
+	if int64(size) > remaining-RECORD_HEADER_SIZE {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, 0, nil, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != sum {
+		return 0, 0, nil, util.CreateInvalidProtocol("wal record checksum mismatch")
+	}
+
+	return header[0], id, payload, nil
+}
+
+type entryMeta struct {
+	Meta    map[string]string `json:"meta,omitempty"`
+	Created time.Time         `json:"created"`
+}
+
+func encodeEntry(entry *Entry) ([]byte, error) {
+	meta, err := json.Marshal(&entryMeta{Meta: entry.Meta, Created: entry.Created})
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, 4, 4+len(meta)+len(entry.Body))
+	binary.BigEndian.PutUint32(payload, uint32(len(meta)))
+	payload = append(payload, meta...)
+	payload = append(payload, entry.Body...)
+
+	return payload, nil
+}
+
+func decodeEntry(id uint64, payload []byte) (*Entry, error) {
+	if len(payload) < 4 {
+		return nil, util.CreateInvalidProtocol("wal entry too short")
+	}
+
+	size := binary.BigEndian.Uint32(payload)
+	if uint32(len(payload)-4) < size {
+		return nil, util.CreateInvalidProtocol("wal entry meta truncated")
+	}
+
+	var meta entryMeta
+	if err := json.Unmarshal(payload[4:4+size], &meta); err != nil {
+		return nil, err
+	}
+
+	return &Entry{
+		ID:      id,
+		Meta:    meta.Meta,
+		Body:    payload[4+size:],
+		Created: meta.Created,
+	}, nil
+}
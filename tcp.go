@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 
@@ -56,16 +56,21 @@ func multiClient(urls []string) {
 type H struct {
 }
 
-func (h *H) Recv(msg []byte) ([]byte, error) {
+func (h *H) Recv(req *comm.Request) ([]byte, error) {
+	msg, err := req.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+
 	fmt.Println(string(msg))
 	return []byte("Hi Client"), nil
 }
 
 func server(url string) {
-	logger := log.New(os.Stdout, "", log.LstdFlags)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	addr, err := net.ResolveTCPAddr("tcp", url)
-	bus, err := comm.CreateBus(addr, &H{}, logger)
+	bus, err := comm.CreateBus(addr, &H{}, comm.DefaultConfig(), logger)
 	if err != nil {
 		fmt.Println(err)
 		return
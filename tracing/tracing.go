@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACER_NAME  = "github.com/soulski/dmp"
+	SERVICE_NAME = "dmp"
+
+	// keys of the W3C trace context, in HTTP headers and comm frame meta.
+	TRACEPARENT = "traceparent"
+	TRACESTATE  = "tracestate"
+
+	ATTR_NAMESPACE     = attribute.Key("dmp.namespace")
+	ATTR_TOPIC         = attribute.Key("dmp.topic")
+	ATTR_PEER          = attribute.Key("dmp.peer")
+	ATTR_CONTACT_POINT = attribute.Key("dmp.contact_point")
+	ATTR_HTTP_STATUS   = semconv.HTTPStatusCodeKey
+)
+
+/*
+
+	The trace context of a message follows it over every hop, from the API
+	call to the comm frame sent to the member and on to the PUT to the
+	contact point, in the W3C traceparent and tracestate. Spans are only
+	recorded once an exporter is set up, until then the context of the
+	caller is passed on untouched.
+
+*/
+
+var propagator = propagation.TraceContext{}
+
+// Setup exports the spans of this node with OTLP over HTTP to endpoint,
+// host:port of a collector. The returned function flushes and stops the
+// export.
+func Setup(endpoint string, nodeName string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(
+		context.Background(),
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(SERVICE_NAME),
+		semconv.ServiceInstanceIDKey.String(nodeName),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+// Start begins a span of kind as a child of the span in ctx.
+func Start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// End ends the span, marking it failed when err is set.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Extract returns ctx with the trace context the carrier holds.
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return propagator.Extract(ctx, carrier)
+}
+
+// Inject writes the trace context of ctx to the carrier.
+func Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	propagator.Inject(ctx, carrier)
+}
@@ -1,7 +1,10 @@
 package util
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"time"
 )
 
 type InvalidArgument struct {
@@ -43,15 +46,170 @@ func (e *InvalidProtocol) Error() string {
 }
 
 type IncompleteMultiErr struct {
-	addrs []string
+	addrs  []string
+	causes map[string]error
 }
 
-func CreateIncompleteMultiErr(failnodes []string) *IncompleteMultiErr {
+func CreateIncompleteMultiErr(failures map[string]error) *IncompleteMultiErr {
+	addrs := make([]string, 0, len(failures))
+	for addr := range failures {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
 	return &IncompleteMultiErr{
-		addrs: failnodes,
+		addrs:  addrs,
+		causes: failures,
 	}
 }
 
 func (e *IncompleteMultiErr) Error() string {
 	return fmt.Sprintf("fail sending to this nodes %s \n", e.addrs)
 }
+
+func (e *IncompleteMultiErr) Addrs() []string {
+	return e.addrs
+}
+
+func (e *IncompleteMultiErr) Cause(addr string) error {
+	return e.causes[addr]
+}
+
+type NotFoundErr struct {
+	kind string
+	id   string
+}
+
+func CreateNotFoundErr(kind string, id string) error {
+	return &NotFoundErr{kind: kind, id: id}
+}
+
+func (e *NotFoundErr) Error() string {
+	return fmt.Sprintf("%s '%s' is not found", e.kind, e.id)
+}
+
+func IsNotFound(err error) bool {
+	var notFound *NotFoundErr
+	return errors.As(err, &notFound)
+}
+
+type RemoteErr struct {
+	cause     string
+	timeout   bool
+	forbidden bool
+}
+
+func CreateRemoteErr(cause string) error {
+	return &RemoteErr{cause: cause}
+}
+
+func CreateRemoteTimeoutErr(cause string) error {
+	return &RemoteErr{cause: cause, timeout: true}
+}
+
+// CreateRemoteForbiddenErr is the refusal of the receiving node to deliver
+// a message its policy does not allow.
+func CreateRemoteForbiddenErr(cause string) error {
+	return &RemoteErr{cause: cause, forbidden: true}
+}
+
+func (e *RemoteErr) Error() string {
+	return fmt.Sprintf("Remote node error : %s", e.cause)
+}
+
+func (e *RemoteErr) Timeout() bool {
+	return e.timeout
+}
+
+func (e *RemoteErr) Forbidden() bool {
+	return e.forbidden
+}
+
+type TimeoutErr struct {
+	op      string
+	timeout time.Duration
+}
+
+func CreateTimeoutErr(op string, timeout time.Duration) error {
+	return &TimeoutErr{op: op, timeout: timeout}
+}
+
+func (e *TimeoutErr) Error() string {
+	return fmt.Sprintf("%s timeout after %s", e.op, e.timeout)
+}
+
+func (e *TimeoutErr) Timeout() bool {
+	return true
+}
+
+func IsTimeout(err error) bool {
+	var timeoutErr interface {
+		Timeout() bool
+	}
+
+	if errors.As(err, &timeoutErr) {
+		return timeoutErr.Timeout()
+	}
+
+	return false
+}
+
+type HTTPStatusErr struct {
+	url    string
+	status int
+}
+
+func CreateHTTPStatusErr(url string, status int) error {
+	return &HTTPStatusErr{url: url, status: status}
+}
+
+func (e *HTTPStatusErr) Error() string {
+	return fmt.Sprintf("%s answered with status %d", e.url, e.status)
+}
+
+type UnauthenticatedErr struct {
+	cause string
+}
+
+func CreateUnauthenticatedErr(cause string) error {
+	return &UnauthenticatedErr{cause: cause}
+}
+
+func (e *UnauthenticatedErr) Error() string {
+	return fmt.Sprintf("Unauthenticated : %s", e.cause)
+}
+
+func IsUnauthenticated(err error) bool {
+	var unauthenticated *UnauthenticatedErr
+	return errors.As(err, &unauthenticated)
+}
+
+type ForbiddenErr struct {
+	identity string
+	action   string
+	resource string
+}
+
+func CreateForbiddenErr(identity string, action string, resource string) error {
+	return &ForbiddenErr{identity: identity, action: action, resource: resource}
+}
+
+func (e *ForbiddenErr) Error() string {
+	return fmt.Sprintf("'%s' may not %s '%s'", e.identity, e.action, e.resource)
+}
+
+func (e *ForbiddenErr) Forbidden() bool {
+	return true
+}
+
+func IsForbidden(err error) bool {
+	var forbidden interface {
+		Forbidden() bool
+	}
+
+	if errors.As(err, &forbidden) {
+		return forbidden.Forbidden()
+	}
+
+	return false
+}
@@ -2,10 +2,16 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"time"
+
+	"github.com/soulski/dmp/tracing"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 func FindAvailableTCPPort(host string) (int, error) {
@@ -15,26 +21,53 @@ func FindAvailableTCPPort(host string) (int, error) {
 	return l.Addr().(*net.TCPAddr).Port, err
 }
 
+const (
+	DEFAULT_HTTP_TIMEOUT = 30 * time.Second
+)
+
+var httpClient = &http.Client{}
+
 func HTTPPut(url string, msg []byte) ([]byte, error) {
-	req, err := http.NewRequest("PUT", url, bytes.NewReader(msg))
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_HTTP_TIMEOUT)
+	defer cancel()
+
+	return HTTPPutStream(ctx, url, bytes.NewReader(msg))
+}
+
+// HTTPPutStream gives up when ctx is done, callers bound the call with a
+// deadline because the client itself has no timeout.
+func HTTPPutStream(ctx context.Context, url string, body io.Reader) ([]byte, error) {
+	_, resBytes, err := HTTPPutStatus(ctx, url, body)
+	return resBytes, err
+}
+
+// HTTPPutStatus is HTTPPutStream that also returns the response status code.
+// The trace context of ctx is sent along.
+func HTTPPutStatus(ctx context.Context, url string, body io.Reader) (int, []byte, error) {
+	req, err := http.NewRequest("PUT", url, body)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, propagation.HeaderCarrier(req.Header))
 
-	client := &http.Client{}
-	res, err := client.Do(req)
+	res, err := httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
 	defer res.Body.Close()
 
 	resBytes, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return res.StatusCode, nil, err
 	}
 
-	return resBytes, nil
+	return res.StatusCode, resBytes, nil
+}
+
+func IsSuccessStatus(status int) bool {
+	return status >= 200 && status < 300
 }